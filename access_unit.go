@@ -0,0 +1,126 @@
+package rtp
+
+import "time"
+
+// accessUnit assembles the NAL units of a frame from RTP packets. The NAL
+// units are copied out of the packets, which are released once processed.
+type accessUnit struct {
+	codec  Codec
+	buf    []byte
+	starts []int
+	nals   [][]byte
+
+	// fragment is set while a fragmented NAL unit, the last one of starts,
+	// is assembled. seq is the sequence number of its last fragment.
+	fragment bool
+	seq      uint16
+
+	timestamp uint32
+	wallclock time.Time
+	keyframe  bool
+
+	clock timestampUnwrapper
+	frame Frame
+}
+
+func newAccessUnit(codec Codec) *accessUnit {
+	return &accessUnit{
+		codec: codec,
+		clock: timestampUnwrapper{bits: 32},
+	}
+}
+
+func (au *accessUnit) empty() bool {
+	return len(au.starts) == 0
+}
+
+// begin starts the access unit of pkt if none is assembled.
+func (au *accessUnit) begin(pkt *Packet) {
+	if au.empty() {
+		au.timestamp = pkt.Timestamp
+		au.wallclock = pkt.wallclock
+	}
+}
+
+func (au *accessUnit) appendNAL(nal []byte, keyframe bool) {
+	au.dropFragment()
+	au.starts = append(au.starts, len(au.buf))
+	au.buf = append(au.buf, nal...)
+	au.keyframe = au.keyframe || keyframe
+}
+
+// startFragment starts a fragmented NAL unit with its reconstructed header.
+func (au *accessUnit) startFragment(seq uint16, header []byte, data []byte) {
+	au.dropFragment()
+	au.starts = append(au.starts, len(au.buf))
+	au.buf = append(au.buf, header...)
+	au.buf = append(au.buf, data...)
+	au.fragment = true
+	au.seq = seq
+}
+
+// appendFragment appends data to the fragmented NAL unit. It returns false
+// and drops the NAL unit when a fragment is missing.
+func (au *accessUnit) appendFragment(seq uint16, data []byte) bool {
+	if !au.fragment || seq != au.seq+1 {
+		au.dropFragment()
+		return false
+	}
+	au.buf = append(au.buf, data...)
+	au.seq = seq
+	return true
+}
+
+func (au *accessUnit) endFragment(keyframe bool) {
+	au.fragment = false
+	au.keyframe = au.keyframe || keyframe
+}
+
+func (au *accessUnit) dropFragment() {
+	if !au.fragment {
+		return
+	}
+	last := len(au.starts) - 1
+	au.buf = au.buf[:au.starts[last]]
+	au.starts = au.starts[:last]
+	au.fragment = false
+}
+
+func (au *accessUnit) reset() {
+	au.buf = au.buf[:0]
+	au.starts = au.starts[:0]
+	au.fragment = false
+	au.keyframe = false
+}
+
+// take returns the assembled frame, or nil if it holds no complete NAL
+// unit, and starts a new access unit. The frame is valid until the next
+// call of any method.
+func (au *accessUnit) take() *Frame {
+	au.dropFragment()
+	if au.empty() {
+		return nil
+	}
+
+	au.nals = au.nals[:0]
+	for i, start := range au.starts {
+		end := len(au.buf)
+		if i+1 < len(au.starts) {
+			end = au.starts[i+1]
+		}
+		au.nals = append(au.nals, au.buf[start:end])
+	}
+
+	pts := ticksToDuration(au.clock.unwrap(uint64(au.timestamp)), videoClockRate)
+	au.frame = Frame{
+		Codec:     au.codec,
+		PTS:       pts,
+		DTS:       pts,
+		Keyframe:  au.keyframe,
+		NALs:      au.nals,
+		Timestamp: au.timestamp,
+		Wallclock: au.wallclock,
+	}
+	au.reset()
+	return &au.frame
+}
@@ -0,0 +1,192 @@
+package rtp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Admitter decides whether a packet from an unknown source creates a new
+// session on srv.
+type Admitter interface {
+	Admit(srv *Server, ssrc uint32, raddr net.Addr) bool
+}
+
+// AdmitFunc adapts a function to an Admitter.
+type AdmitFunc func(srv *Server, ssrc uint32, raddr net.Addr) bool
+
+func (fn AdmitFunc) Admit(srv *Server, ssrc uint32, raddr net.Addr) bool {
+	return fn(srv, ssrc, raddr)
+}
+
+// AdmissionPolicy is an Admitter limiting sessions by source network,
+// SSRC and count. Zero fields do not restrict admission.
+type AdmissionPolicy struct {
+	// AllowNetworks, when not empty, admits only sources within them.
+	AllowNetworks []*net.IPNet
+	// DenyNetworks rejects sources within them.
+	DenyNetworks []*net.IPNet
+	// AllowSSRC, when not nil, admits only the SSRCs it returns true for.
+	AllowSSRC func(ssrc uint32) bool
+	// MaxSessions limits the number of sessions of the server.
+	MaxSessions int
+	// MaxSessionsPerSource limits the number of sessions of one source IP.
+	MaxSessionsPerSource int
+}
+
+// sessionLimits bounds the sessions added by addSessionLimited, zero
+// fields do not restrict.
+type sessionLimits struct {
+	max       int
+	perSource int
+}
+
+// sessionLimiter is implemented by admitters limiting the session count,
+// which is checked again when the session is added so concurrent readers
+// can't exceed it.
+type sessionLimiter interface {
+	sessionLimits() sessionLimits
+}
+
+func (policy *AdmissionPolicy) sessionLimits() sessionLimits {
+	return sessionLimits{max: policy.MaxSessions, perSource: policy.MaxSessionsPerSource}
+}
+
+func (policy *AdmissionPolicy) Admit(srv *Server, ssrc uint32, raddr net.Addr) bool {
+	ip := addrIP(raddr)
+	if len(policy.AllowNetworks) > 0 && !containsIP(policy.AllowNetworks, ip) {
+		return false
+	}
+	if containsIP(policy.DenyNetworks, ip) {
+		return false
+	}
+	if policy.AllowSSRC != nil && !policy.AllowSSRC(ssrc) {
+		return false
+	}
+	if policy.MaxSessions > 0 && srv.SessionCount() >= policy.MaxSessions {
+		return false
+	}
+	if policy.MaxSessionsPerSource > 0 && srv.SourceSessionCount(raddr) >= policy.MaxSessionsPerSource {
+		return false
+	}
+	return true
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// sourceKey identifies the source of addr for per source limits.
+func sourceKey(addr net.Addr) string {
+	if ip := addrIP(addr); ip != nil {
+		return ip.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// SessionCount returns the number of sessions of the server.
+func (srv *Server) SessionCount() int {
+	return int(atomic.LoadInt64(&srv.sessionCount))
+}
+
+// SourceSessionCount returns the number of sessions whose remote address
+// has the same IP as addr.
+func (srv *Server) SourceSessionCount(addr net.Addr) int {
+	srv.sourceMux.Lock()
+	defer srv.sourceMux.Unlock()
+	return srv.sourceCounts[sourceKey(addr)]
+}
+
+// Results of addSessionLimited.
+const (
+	addSessionOK = iota
+	// addSessionExists is returned when a session with the same key exists.
+	addSessionExists
+	// addSessionLimited is returned when the session limits are reached.
+	addSessionLimited
+)
+
+// addSession registers sess by its demux key, it returns false if a
+// session with the same key exists.
+func (srv *Server) addSession(sess *Session) bool {
+	return srv.addSessionLimited(sess, sessionLimits{}) == addSessionOK
+}
+
+// addSessionLimited registers sess unless a session with the same key
+// exists or limits are reached. The counts are checked and reserved under
+// sourceMux, so sessions added concurrently can't exceed them.
+func (srv *Server) addSessionLimited(sess *Session, limits sessionLimits) int {
+	sess.mux.RLock()
+	key, addr := sess.key, sess.addr
+	sess.mux.RUnlock()
+	source := sourceKey(addr)
+
+	srv.sourceMux.Lock()
+	defer srv.sourceMux.Unlock()
+	if _, ok := srv.sessions.Load(key); ok {
+		return addSessionExists
+	}
+	if limits.max > 0 && srv.SessionCount() >= limits.max {
+		return addSessionLimited
+	}
+	if limits.perSource > 0 && srv.sourceCounts[source] >= limits.perSource {
+		return addSessionLimited
+	}
+	if _, loaded := srv.sessions.LoadOrStore(key, sess); loaded {
+		return addSessionExists
+	}
+	atomic.AddInt64(&srv.sessionCount, 1)
+
+	if srv.sourceCounts == nil {
+		srv.sourceCounts = make(map[string]int)
+	}
+	srv.sourceCounts[source]++
+	return addSessionOK
+}
+
+func (srv *Server) removeSession(sess *Session) {
+	sess.mux.RLock()
+	key, addr := sess.key, sess.addr
+	sess.mux.RUnlock()
+	if srv.sessions == nil || key == nil {
+		return
+	}
+
+	source := sourceKey(addr)
+	srv.sourceMux.Lock()
+	defer srv.sourceMux.Unlock()
+	if !srv.sessions.CompareAndDelete(key, sess) {
+		return
+	}
+	atomic.AddInt64(&srv.sessionCount, -1)
+	srv.sourceCounts[source]--
+	if srv.sourceCounts[source] <= 0 {
+		delete(srv.sourceCounts, source)
+	}
+}
@@ -0,0 +1,433 @@
+package rtp
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrUnknownAsyncPolicy = fmt.Errorf("unknown async policy")
+
+var defaultAsyncQueueSize = 256
+
+// asyncQueued and asyncDropped sum the queue depth and the drops of every
+// async stage of the process, including the branches of tees.
+var (
+	asyncQueued  int64
+	asyncDropped uint64
+)
+
+// AsyncPolicy decides what an async stage does when its queue is full.
+type AsyncPolicy uint8
+
+const (
+	// AsyncBlock waits for room in the queue, applying backpressure.
+	AsyncBlock AsyncPolicy = iota
+	// AsyncDropOldest drops the oldest queued value.
+	AsyncDropOldest
+	// AsyncDropUntilKeyframe drops the queued values and every value until
+	// the next keyframe, which the dropped ones may be referenced by. It
+	// needs frames or FLV tags, the keyframes of packets aren't detected.
+	AsyncDropUntilKeyframe
+)
+
+func (policy AsyncPolicy) String() string {
+	switch policy {
+	case AsyncBlock:
+		return "block"
+	case AsyncDropOldest:
+		return "drop-oldest"
+	case AsyncDropUntilKeyframe:
+		return "drop-until-keyframe"
+	}
+	return fmt.Sprintf("AsyncPolicy(%d)", uint8(policy))
+}
+
+// ParseAsyncPolicy parses the name of a policy as returned by String.
+func ParseAsyncPolicy(name string) (AsyncPolicy, error) {
+	for _, policy := range []AsyncPolicy{AsyncBlock, AsyncDropOldest, AsyncDropUntilKeyframe} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownAsyncPolicy, name)
+}
+
+// Async is a stage processing clones of the values on its own goroutine
+// behind a bounded queue, so a slow next stage, e.g. a blocking rtmp write,
+// doesn't stall the session. An error of the next stage is returned by the
+// following Process. Packets dropped by a full queue are reported to the
+// next stage as a Gap.
+type Async[T interface{ Clone() T }] struct {
+	next   Stage[T]
+	policy AsyncPolicy
+	logger *slog.Logger
+	// onKeyframe is passed on to next
+	onKeyframe func()
+	// onError, when set, is called when the next stage fails
+	onError func(err error)
+
+	// mux serializes the producers, the queue has a single one
+	mux     sync.Mutex
+	queue   chan asyncItem[T]
+	started bool
+	// waiting is set while AsyncDropUntilKeyframe drops until a keyframe
+	waiting bool
+	dropped uint64
+
+	quit   chan bool
+	once   sync.Once
+	exited chan bool
+	err    atomic.Value
+
+	// nextSeq is the sequence number of the packet expected by the next
+	// stage, only used by the goroutine processing the queue
+	nextSeq  uint16
+	seqKnown bool
+}
+
+type asyncItem[T any] struct {
+	v     T
+	gap   *Gap
+	flush chan error
+}
+
+// AsyncStats is a snapshot of an async stage.
+type AsyncStats struct {
+	Queued   int
+	Capacity int
+	Dropped  uint64
+}
+
+// NewAsync returns an async stage queuing up to queueSize values, it
+// defaults to 256. It panics if policy is AsyncDropUntilKeyframe and T is
+// neither *Frame nor *FlvTag.
+func NewAsync[T interface{ Clone() T }](queueSize int, policy AsyncPolicy) *Async[T] {
+	if policy == AsyncDropUntilKeyframe && !detectsKeyframes(*new(T)) {
+		panic(fmt.Sprintf("rtp: async policy %s of %T", policy, *new(T)))
+	}
+	if queueSize <= 0 {
+		queueSize = defaultAsyncQueueSize
+	}
+	return &Async[T]{
+		policy: policy,
+		logger: logger,
+		queue:  make(chan asyncItem[T], queueSize),
+		quit:   make(chan bool),
+		exited: make(chan bool),
+	}
+}
+
+// Attach sets the next stage, it must be called before the first Process.
+func (async *Async[T]) Attach(next Stage[T]) {
+	setLogger(next, async.logger)
+	setKeyframeFunc(next, async.onKeyframe)
+	old := async.next
+	async.next = next
+	if old != nil {
+		old.Release()
+	}
+}
+
+func (async *Async[T]) SetLogger(logger *slog.Logger) {
+	async.logger = logger
+	setLogger(async.next, logger)
+}
+
+func (async *Async[T]) SetKeyframeFunc(fn func()) {
+	async.onKeyframe = fn
+	setKeyframeFunc(async.next, fn)
+}
+
+// Stats returns a snapshot of the queue.
+func (async *Async[T]) Stats() AsyncStats {
+	return AsyncStats{
+		Queued:   len(async.queue),
+		Capacity: cap(async.queue),
+		Dropped:  atomic.LoadUint64(&async.dropped),
+	}
+}
+
+// Process queues a clone of v as the policy allows. It returns the error
+// the next stage failed with, if any.
+func (async *Async[T]) Process(v T) error {
+	if err := async.Err(); err != nil {
+		return err
+	}
+
+	async.mux.Lock()
+	defer async.mux.Unlock()
+	async.start()
+
+	keyframe := async.policy == AsyncDropUntilKeyframe && isKeyframe(v)
+	if async.waiting {
+		if !keyframe {
+			async.drop(1)
+			return nil
+		}
+		async.waiting = false
+	}
+	if !async.makeRoom(keyframe) || async.waiting {
+		async.drop(1)
+		return nil
+	}
+
+	if !async.enqueue(asyncItem[T]{v: v.Clone()}, async.policy == AsyncBlock) {
+		return async.Err()
+	}
+	return nil
+}
+
+// Gap is queued and passed on to the next stage in order.
+func (async *Async[T]) Gap(gap Gap) {
+	async.mux.Lock()
+	defer async.mux.Unlock()
+	async.start()
+	if async.makeRoom(false) {
+		async.enqueue(asyncItem[T]{gap: &gap}, async.policy == AsyncBlock)
+	}
+}
+
+// Flush waits for the queue to be processed and flushes the next stage.
+func (async *Async[T]) Flush() error {
+	async.mux.Lock()
+	async.start()
+	done := make(chan error, 1)
+	ok := async.enqueue(asyncItem[T]{flush: done}, true)
+	async.mux.Unlock()
+	if !ok {
+		return async.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-async.exited:
+		return async.Err()
+	}
+}
+
+// Release stops the stage, which releases the next one once the queue is
+// processed.
+func (async *Async[T]) Release() {
+	async.once.Do(func() {
+		close(async.quit)
+	})
+	async.mux.Lock()
+	async.start()
+	async.mux.Unlock()
+}
+
+// Err returns the error the next stage failed with.
+func (async *Async[T]) Err() error {
+	if err, ok := async.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// start starts the goroutine processing the queue, async.mux is held.
+func (async *Async[T]) start() {
+	if !async.started {
+		async.started = true
+		go async.loop()
+	}
+}
+
+// enqueue queues item, waiting for room when block is set. It returns false
+// if the stage is released or, without block, the queue is full.
+func (async *Async[T]) enqueue(item asyncItem[T], block bool) bool {
+	select {
+	case <-async.quit:
+		return false
+	case <-async.exited:
+		return false
+	default:
+	}
+
+	if block {
+		select {
+		case async.queue <- item:
+		case <-async.quit:
+			return false
+		case <-async.exited:
+			return false
+		}
+	} else {
+		select {
+		case async.queue <- item:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt64(&asyncQueued, 1)
+	return true
+}
+
+// makeRoom drops queued values as the policy allows when the queue is
+// full, so a value is only cloned once it can be queued. It returns false
+// if the queue is still full. With AsyncDropUntilKeyframe, the next values
+// are dropped until a keyframe unless keyframe is set. async.mux is held,
+// only the holder adds to the queue.
+func (async *Async[T]) makeRoom(keyframe bool) bool {
+	if async.policy == AsyncBlock || len(async.queue) < cap(async.queue) {
+		return true
+	}
+
+	switch async.policy {
+	case AsyncDropOldest:
+		async.drop(async.drain(1))
+	case AsyncDropUntilKeyframe:
+		async.drop(async.drain(cap(async.queue)))
+		async.waiting = !keyframe
+	}
+	return len(async.queue) < cap(async.queue)
+}
+
+// drain drops up to max queued values from the oldest, keeping gaps and
+// flushes in order, and returns the number of values dropped. async.mux is
+// held.
+func (async *Async[T]) drain(max int) (count int) {
+	var kept []asyncItem[T]
+	// the values following a kept item are read to keep the order
+	for done := false; !done && (count < max || len(kept) > 0); {
+		select {
+		case item := <-async.queue:
+			atomic.AddInt64(&asyncQueued, -1)
+			if count < max && item.flush == nil && item.gap == nil {
+				count++
+			} else {
+				kept = append(kept, item)
+			}
+		default:
+			done = true
+		}
+	}
+	for _, item := range kept {
+		async.queue <- item
+		atomic.AddInt64(&asyncQueued, 1)
+	}
+	return count
+}
+
+func (async *Async[T]) drop(count int) {
+	if count == 0 {
+		return
+	}
+	atomic.AddUint64(&async.dropped, uint64(count))
+	atomic.AddUint64(&asyncDropped, uint64(count))
+	async.logger.Debug("async queue full, drop", "count", count, "policy", async.policy)
+}
+
+func (async *Async[T]) loop() {
+	defer func() {
+		// answer what a failed next stage left queued
+		async.mux.Lock()
+		defer async.mux.Unlock()
+		for len(async.queue) > 0 {
+			item := <-async.queue
+			atomic.AddInt64(&asyncQueued, -1)
+			if item.flush != nil {
+				item.flush <- async.Err()
+			}
+		}
+	}()
+	defer close(async.exited)
+	defer func() {
+		if async.next != nil {
+			async.next.Release()
+		}
+	}()
+
+	for {
+		select {
+		case item := <-async.queue:
+			atomic.AddInt64(&asyncQueued, -1)
+			if !async.handle(item) {
+				return
+			}
+		case <-async.quit:
+			// process what was queued before the stage was released
+			for {
+				select {
+				case item := <-async.queue:
+					atomic.AddInt64(&asyncQueued, -1)
+					if !async.handle(item) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handle processes item, it returns false once the next stage failed.
+func (async *Async[T]) handle(item asyncItem[T]) bool {
+	next := async.next
+	switch {
+	case next == nil:
+		if item.flush != nil {
+			item.flush <- nil
+		}
+	case item.flush != nil:
+		item.flush <- flush(next)
+	case item.gap != nil:
+		async.seqKnown = true
+		async.nextSeq = item.gap.SequenceNumber + item.gap.Count
+		if handler, ok := next.(GapHandler); ok {
+			handler.Gap(*item.gap)
+		}
+	default:
+		async.reportDropped(next, item.v)
+		if err := next.Process(item.v); err != nil {
+			async.logger.Warn("async stage failed", "err", err)
+			async.err.Store(err)
+			if async.onError != nil {
+				async.onError(err)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// reportDropped notifies next of the packets dropped before v, which is
+// otherwise the packet following the previous one or gap.
+func (async *Async[T]) reportDropped(next Stage[T], v T) {
+	pkt, ok := interface{}(v).(*Packet)
+	if !ok {
+		return
+	}
+	if async.seqKnown && pkt.SequenceNumber != async.nextSeq {
+		if handler, ok := next.(GapHandler); ok {
+			handler.Gap(Gap{SSRC: pkt.SSRC, SequenceNumber: async.nextSeq, Count: pkt.SequenceNumber - async.nextSeq})
+		}
+	}
+	async.seqKnown = true
+	async.nextSeq = pkt.SequenceNumber + 1
+}
+
+// detectsKeyframes tells if isKeyframe detects the keyframes of the type
+// of v.
+func detectsKeyframes(v interface{}) bool {
+	switch v.(type) {
+	case *Frame, *FlvTag:
+		return true
+	}
+	return false
+}
+
+// isKeyframe tells if v starts a decodable sequence, values of types
+// whose keyframes aren't detected always do.
+func isKeyframe(v interface{}) bool {
+	switch v := v.(type) {
+	case *Frame:
+		return v.Keyframe
+	case *FlvTag:
+		return v.TagType != TAG_VIDEO || len(v.Data) == 0 || v.Data[0]>>4 == FRAME_TYPE_KEY
+	}
+	return true
+}
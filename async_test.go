@@ -0,0 +1,79 @@
+package rtp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// packetRecorder records the sequence numbers and gaps it receives,
+// blocking on unblock until it is closed.
+type packetRecorder struct {
+	started chan bool
+	unblock chan bool
+	events  []string
+}
+
+func (recorder *packetRecorder) Process(pkt *Packet) error {
+	if recorder.started != nil {
+		close(recorder.started)
+		recorder.started = nil
+	}
+	<-recorder.unblock
+	recorder.events = append(recorder.events, fmt.Sprintf("seq %d", pkt.SequenceNumber))
+	return nil
+}
+
+func (recorder *packetRecorder) Gap(gap Gap) {
+	recorder.events = append(recorder.events, fmt.Sprintf("gap %d+%d", gap.SequenceNumber, gap.Count))
+}
+
+func (recorder *packetRecorder) Release() {}
+
+func TestAsyncDropOldestReportsGap(t *testing.T) {
+	recorder := &packetRecorder{started: make(chan bool), unblock: make(chan bool)}
+	started := recorder.started
+	async := NewAsync[*Packet](2, AsyncDropOldest)
+	async.Attach(recorder)
+
+	builder := NewPacketBuilder(1, 96, 0)
+	async.Process(builder.Build(nil, 0, false))
+	<-started
+	for i := 1; i < 5; i++ {
+		async.Process(builder.Build(nil, 0, false))
+	}
+	close(recorder.unblock)
+	if err := async.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	async.Release()
+
+	want := []string{"seq 0", "gap 1+2", "seq 3", "seq 4"}
+	if len(recorder.events) != len(want) {
+		t.Fatalf("got %v, want %v", recorder.events, want)
+	}
+	for i := range want {
+		if recorder.events[i] != want[i] {
+			t.Fatalf("got %v, want %v", recorder.events, want)
+		}
+	}
+	if dropped := async.Stats().Dropped; dropped != 2 {
+		t.Fatalf("got %d dropped, want 2", dropped)
+	}
+}
+
+func TestAsyncDropUntilKeyframeOfPackets(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewAsync of packets dropping until keyframe didn't panic")
+		}
+	}()
+	NewAsync[*Packet](0, AsyncDropUntilKeyframe)
+}
+
+func TestPipelineRejectsPacketKeyframePolicy(t *testing.T) {
+	_, err := DefaultRegistry.BuildString("async(drop-until-keyframe) -> h264 -> flv -> rtmp://host/app/stream")
+	if !errors.Is(err, ErrStageMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrStageMismatch)
+	}
+}
@@ -0,0 +1,158 @@
+package rtp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// DemuxMode selects the key demultiplexing packets into sessions.
+type DemuxMode int
+
+const (
+	// DemuxBySSRC shares a session between every address sending an SSRC.
+	DemuxBySSRC DemuxMode = iota
+	// DemuxByAddr creates a session per remote address whatever its SSRC.
+	DemuxByAddr
+	// DemuxByAddrSSRC creates a session per remote address and SSRC.
+	DemuxByAddrSSRC
+)
+
+type addrSSRCKey struct {
+	addr string
+	ssrc uint32
+}
+
+func (srv *Server) sessionKey(ssrc uint32, raddr net.Addr) interface{} {
+	switch srv.Demux {
+	case DemuxByAddr:
+		return raddr.String()
+	case DemuxByAddrSSRC:
+		return addrSSRCKey{addr: raddr.String(), ssrc: ssrc}
+	}
+	return ssrc
+}
+
+// lookupSession returns the session of a packet of ssrc from raddr. It
+// returns nil if the packet starts a new session, and drop is true if
+// the packet must be discarded.
+func (srv *Server) lookupSession(ssrc uint32, raddr net.Addr) (sess *Session, drop bool) {
+	val, ok := srv.sessions.Load(srv.sessionKey(ssrc, raddr))
+	if ok {
+		sess = val.(*Session)
+		switch srv.Demux {
+		case DemuxBySSRC:
+			if addr := sess.Addr(); addr.String() != raddr.String() {
+				if !srv.addrChanged(sess, ssrc, raddr) {
+					atomic.AddUint64(&srv.ssrcCollisions, 1)
+					sess.log().Debug("ssrc collision, drop packet", "from", raddr.String())
+					return nil, true
+				}
+			}
+		case DemuxByAddr:
+			if sess.SSRC() != ssrc {
+				sess.log().Info("session ssrc changed", "new_ssrc", ssrc)
+				if !srv.moveSession(sess, ssrc, raddr) {
+					return nil, true
+				}
+			}
+		}
+		return sess, false
+	}
+
+	if srv.Demux != DemuxBySSRC && srv.OnAddrChange != nil {
+		if sess = srv.session(ssrc, nil); sess != nil && srv.addrChanged(sess, ssrc, raddr) {
+			return sess, false
+		}
+	}
+	return nil, false
+}
+
+// addrChanged asks OnAddrChange whether sess follows raddr, and moves it
+// if so. Refused addresses are remembered to call OnAddrChange once.
+func (srv *Server) addrChanged(sess *Session, ssrc uint32, raddr net.Addr) bool {
+	if srv.OnAddrChange == nil {
+		return false
+	}
+
+	sess.mux.RLock()
+	rejected := sess.rejectedAddrs[raddr.String()]
+	sess.mux.RUnlock()
+	if rejected {
+		return false
+	}
+
+	if !srv.OnAddrChange(sess, raddr) {
+		sess.mux.Lock()
+		if sess.rejectedAddrs == nil {
+			sess.rejectedAddrs = make(map[string]bool)
+		}
+		sess.rejectedAddrs[raddr.String()] = true
+		sess.mux.Unlock()
+		return false
+	}
+
+	sess.log().Info("session follow new addr", "new_remote_addr", raddr.String())
+	return srv.moveSession(sess, ssrc, raddr)
+}
+
+// moveSession binds sess to ssrc and raddr. If another session was added
+// with the new key meanwhile, sess is closed and false is returned.
+func (srv *Server) moveSession(sess *Session, ssrc uint32, raddr net.Addr) bool {
+	srv.removeSession(sess)
+	sess.mux.Lock()
+	sess.ssrc = ssrc
+	sess.addr = raddr
+	sess.key = srv.sessionKey(ssrc, raddr)
+	sess.rtcpAddr = nil
+	sess.setLogger()
+	sess.mux.Unlock()
+	if !srv.addSession(sess) {
+		sess.log().Warn("session with new key exists, will be closed")
+		sess.terminate(fmt.Errorf("session ssrc=%d exists", ssrc))
+		return false
+	}
+	return true
+}
+
+// session returns a session receiving ssrc, preferring one whose remote
+// IP is the one of raddr when raddr is not nil.
+func (srv *Server) session(ssrc uint32, raddr net.Addr) *Session {
+	if srv.sessions == nil {
+		return nil
+	}
+	if srv.Demux == DemuxBySSRC {
+		val, ok := srv.sessions.Load(ssrc)
+		if !ok {
+			return nil
+		}
+		return val.(*Session)
+	}
+
+	var found *Session
+	ip := addrIP(raddr)
+	srv.sessions.Range(func(key interface{}, val interface{}) bool {
+		sess := val.(*Session)
+		if sess.SSRC() != ssrc {
+			return true
+		}
+		found = sess
+		return ip != nil && !ip.Equal(addrIP(sess.Addr()))
+	})
+	return found
+}
+
+// rtcpSession returns the session of ssrc if its remote IP is the one of
+// raddr. RTCP from another host is ignored, so it can neither close the
+// session with a BYE nor redirect its reports.
+func (srv *Server) rtcpSession(ssrc uint32, raddr net.Addr) *Session {
+	sess := srv.session(ssrc, raddr)
+	if sess == nil {
+		return nil
+	}
+	if ip := addrIP(raddr); ip == nil || !ip.Equal(addrIP(sess.Addr())) {
+		sess.log().Debug("rtcp from another host, ignore", "from", raddr.String())
+		return nil
+	}
+	return sess
+}
@@ -0,0 +1,112 @@
+package rtp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Expect registers a session for ssrc before the device starts sending,
+// typically while handling the signalling of a call. Packets of ssrc are
+// processed by processor, and the session is neither delivered to Accept
+// nor to Handler. Close the session to cancel the registration.
+func (srv *Server) Expect(ssrc uint32, processor Processor) (*Session, error) {
+	return srv.expect(ssrc, ssrc, processor)
+}
+
+// ExpectAddr registers a session for the first SSRC received from addr,
+// which is either host:port or host. See Expect.
+func (srv *Server) ExpectAddr(addr string, processor Processor) (*Session, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("expected addr is empty")
+	}
+	return srv.expect(addr, 0, processor)
+}
+
+// anySource is the expect key matching the first packet of any source.
+type anySource struct{}
+
+// expectAny registers a session for the first packet received by srv.
+func (srv *Server) expectAny(processor Processor) (*Session, error) {
+	return srv.expect(anySource{}, 0, processor)
+}
+
+func (srv *Server) expect(key interface{}, ssrc uint32, processor Processor) (*Session, error) {
+	srv.mux.Lock()
+	running := srv.state == serverStatusRunning
+	srv.mux.Unlock()
+	if !running {
+		return nil, fmt.Errorf("server is not running")
+	}
+
+	if ssrc, ok := key.(uint32); ok {
+		if srv.session(ssrc, nil) != nil {
+			return nil, fmt.Errorf("session ssrc=%d exists", ssrc)
+		}
+	}
+
+	sess := newSession(ssrc, nil, srv)
+	sess.expectKey = key
+	if processor != nil {
+		sess.Attach(processor)
+	}
+	if _, loaded := srv.expected.LoadOrStore(key, sess); loaded {
+		return nil, fmt.Errorf("session %v is already expected", key)
+	}
+	return sess, nil
+}
+
+// activateExpected returns the session expected for ssrc or raddr, bound
+// to them, or nil if none was registered or a session of the same key
+// exists, which closes the expected one.
+func (srv *Server) activateExpected(ssrc uint32, raddr net.Addr, conn *tcpConn) *Session {
+	val, ok := srv.expected.LoadAndDelete(ssrc)
+	if !ok {
+		val, ok = srv.expected.LoadAndDelete(raddr.String())
+	}
+	if !ok {
+		if host, _, err := net.SplitHostPort(raddr.String()); err == nil {
+			val, ok = srv.expected.LoadAndDelete(host)
+		}
+	}
+	if !ok {
+		val, ok = srv.expected.LoadAndDelete(anySource{})
+	}
+	if !ok {
+		return nil
+	}
+
+	sess := val.(*Session)
+	sess.mux.Lock()
+	sess.ssrc = ssrc
+	sess.addr = raddr
+	sess.key = srv.sessionKey(ssrc, raddr)
+	sess.conn = conn
+	sess.expectKey = nil
+	sess.setLogger()
+	processor := sess.processor
+	sess.mux.Unlock()
+	setLogger(processor, sess.logger)
+
+	atomic.StoreInt64(&sess.lastActiveTime, time.Now().UnixNano())
+	if !srv.addSession(sess) {
+		// created concurrently by another reader
+		sess.logger.Warn("expected session exists, will be closed")
+		sess.close(fmt.Errorf("session ssrc=%d exists", ssrc))
+		sess.release()
+		return nil
+	}
+	atomic.AddUint64(&srv.acceptedSessions, 1)
+	return sess
+}
+
+func (srv *Server) cancelExpect(sess *Session) {
+	sess.mux.RLock()
+	key := sess.expectKey
+	sess.mux.RUnlock()
+	// a session closed before its first packet never started
+	if key != nil && srv.expected != nil && srv.expected.CompareAndDelete(key, sess) {
+		sess.release()
+	}
+}
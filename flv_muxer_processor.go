@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"log/slog"
 	"math"
 	"sync"
+	"time"
 
 	amf "github.com/zhangpeihao/goamf"
 )
@@ -13,29 +15,32 @@ import (
 type flvMuxerProcessor struct {
 	SPS, PPS                      []byte
 	SPSSent                       bool
-	firstTimestamp                uint32
-	next                          Processor
+	next                          Stage[*FlvTag]
 	mux                           sync.Mutex
-	lastTimestamp                 uint32
-	deltaTimestamp                uint32
+	lastDTS                       time.Duration
+	deltaDTS                      time.Duration
 	videoData                     *bytes.Buffer
 	audioData                     *bytes.Buffer
 	avcDecoderConfigurationRecord *bytes.Buffer
 	metaData                      *bytes.Buffer
+	logger                        *slog.Logger
 }
 
-func NewFlvMuxerProcessor() Processor {
+// NewFlvMuxerProcessor returns a muxer of H.264 frames into FLV tags.
+func NewFlvMuxerProcessor() Muxer {
 	proc := &flvMuxerProcessor{
 		videoData:                     new(bytes.Buffer),
 		audioData:                     new(bytes.Buffer),
 		avcDecoderConfigurationRecord: new(bytes.Buffer),
 		metaData:                      new(bytes.Buffer),
+		logger:                        logger,
 	}
 
 	return proc
 }
 
-func (proc *flvMuxerProcessor) Attach(next Processor) {
+func (proc *flvMuxerProcessor) Attach(next Stage[*FlvTag]) {
+	setLogger(next, proc.logger)
 	old := proc.next
 	proc.next = next
 	if old != nil {
@@ -43,120 +48,85 @@ func (proc *flvMuxerProcessor) Attach(next Processor) {
 	}
 }
 
+func (proc *flvMuxerProcessor) SetLogger(logger *slog.Logger) {
+	proc.logger = logger
+	setLogger(proc.next, logger)
+}
+
 func (proc *flvMuxerProcessor) Release() {
 	next := proc.next
-	next.Release()
+	if next != nil {
+		next.Release()
+	}
 }
 
-func (proc *flvMuxerProcessor) nextProcess(pkt interface{}) error {
+func (proc *flvMuxerProcessor) Flush() error {
+	return flush(proc.next)
+}
+
+func (proc *flvMuxerProcessor) nextProcess(flvTag *FlvTag) error {
 	next := proc.next
 	if next != nil {
-		return next.Process(pkt)
+		return next.Process(flvTag)
 	}
 	return nil
 }
 
-func (proc *flvMuxerProcessor) Process(pkt interface{}) error {
-	packet, _ := pkt.(*Packet)
-	if proc.firstTimestamp == 0 {
-		proc.firstTimestamp = packet.Timestamp
+func (proc *flvMuxerProcessor) Process(frame *Frame) error {
+	if frame.Codec != CodecH264 {
+		proc.logger.Debug("flv muxer drop frame", "codec", frame.Codec)
+		return nil
 	}
 
-	deltaTimestamp := packet.Timestamp - proc.lastTimestamp
-	if proc.deltaTimestamp == 0 || (deltaTimestamp < proc.deltaTimestamp && deltaTimestamp > 0) {
-		proc.deltaTimestamp = deltaTimestamp
+	if delta := frame.DTS - proc.lastDTS; delta > 0 && (proc.deltaDTS == 0 || delta < proc.deltaDTS) {
+		proc.deltaDTS = delta
 	}
+	proc.lastDTS = frame.DTS
 
-	defer func() {
-		proc.lastTimestamp = packet.Timestamp
-	}()
-
-	dts := uint32((packet.Timestamp - proc.firstTimestamp) / 90)
-	pts := dts + 10
-
-	var videoDataPayload []byte
-
-	nalt := packet.Payload[0] & 31
-
-	switch nalt {
-	case 7:
-		proc.SPS = packet.Payload
-	case 8:
-		proc.PPS = packet.Payload
+	nals := make([][]byte, 0, len(frame.NALs))
+	for _, nal := range frame.NALs {
+		switch nal[0] & 31 {
+		case 7:
+			proc.SPS = append(proc.SPS[:0], nal...)
+		case 8:
+			proc.PPS = append(proc.PPS[:0], nal...)
+		case 9:
+			// access unit delimiter
+		default:
+			nals = append(nals, nal)
+		}
 	}
-	if nalt == 7 || nalt == 8 {
-		if proc.SPS != nil && proc.PPS != nil && proc.SPSSent == false && proc.deltaTimestamp > 0 {
-			sps := unmarshalH264SPS(proc.SPS)
-			if sps == nil {
-				return nil
-			}
 
-			metaData := &MetaData{
-				FrameRate:    90000 / proc.deltaTimestamp,
-				HasVideo:     true,
-				Height:       (sps.PicHeightInMapUnitsMinus1 + 1) * 16,
-				Width:        (sps.PicWidthInMbsMinus1 + 1) * 16,
-				VideoCodecID: CODEC_AVC,
-			}
-			proc.metaData.Reset()
-			metaData.WriteTo(proc.metaData)
-			metaDataPayload := proc.metaData.Bytes()
-			flvTag := &FlvTag{
-				TagType:   TAG_SCRIPT,
-				DataSize:  uint32(len(metaDataPayload)),
-				Timestamp: 0,
-				Data:      metaDataPayload,
-			}
+	dts := uint32(frame.DTS / time.Millisecond)
+	cts := int32((frame.PTS - frame.DTS) / time.Millisecond)
 
-			if err := proc.nextProcess(flvTag); err != nil {
-				return err
-			}
-
-			record := &AVCDecoderConfigurationRecord{
-				ConfigurationVersion: 1,
-				AVCProfileIndication: proc.SPS[1],
-				ProfileCompatibility: proc.SPS[2],
-				AVCLevelIndication:   proc.SPS[3],
-				SPS:                  proc.SPS,
-				PPS:                  proc.PPS,
-			}
-			proc.avcDecoderConfigurationRecord.Reset()
-			record.WriteTo(proc.avcDecoderConfigurationRecord)
-			videoData := &VideoData{
-				FrameType:       FRAME_TYPE_KEY,
-				CodecID:         CODEC_AVC,
-				AVCPacketType:   AVC_SEQ_HEADER,
-				CompositionTime: int32(pts - dts),
-				Data:            proc.avcDecoderConfigurationRecord.Bytes(),
-			}
-			proc.videoData.Reset()
-			videoData.WriteTo(proc.videoData)
-			videoDataPayload = proc.videoData.Bytes()
-			proc.SPSSent = true
-		} else {
+	if !proc.SPSSent {
+		if proc.SPS == nil || proc.PPS == nil || !frame.Keyframe {
 			return nil
 		}
-	} else if proc.SPSSent {
-		videoData := &VideoData{
-			FrameType:       FRAME_TYPE_INTER,
-			CodecID:         CODEC_AVC,
-			AVCPacketType:   AVC_NALU,
-			CompositionTime: int32(pts - dts),
-			Data:            packet.Payload,
-		}
-
-		if nalt == 5 {
-			videoData.FrameType = FRAME_TYPE_KEY
+		if err := proc.sendSequenceHeader(dts, cts); err != nil {
+			return err
 		}
-		proc.videoData.Reset()
-		videoData.WriteTo(proc.videoData)
-		videoDataPayload = proc.videoData.Bytes()
 	}
 
-	if videoDataPayload == nil {
+	if len(nals) == 0 {
 		return nil
 	}
 
+	videoData := &VideoData{
+		FrameType:       FRAME_TYPE_INTER,
+		CodecID:         CODEC_AVC,
+		AVCPacketType:   AVC_NALU,
+		CompositionTime: cts,
+		NALs:            nals,
+	}
+	if frame.Keyframe {
+		videoData.FrameType = FRAME_TYPE_KEY
+	}
+	proc.videoData.Reset()
+	videoData.WriteTo(proc.videoData)
+	videoDataPayload := proc.videoData.Bytes()
+
 	flvTag := &FlvTag{
 		TagType:   TAG_VIDEO,
 		DataSize:  uint32(len(videoDataPayload)),
@@ -167,6 +137,72 @@ func (proc *flvMuxerProcessor) Process(pkt interface{}) error {
 	return proc.nextProcess(flvTag)
 }
 
+// sendSequenceHeader sends the metadata and the AVC sequence header built
+// from the latest SPS and PPS, before the first keyframe.
+func (proc *flvMuxerProcessor) sendSequenceHeader(dts uint32, cts int32) error {
+	if len(proc.SPS) < 4 {
+		return nil
+	}
+	sps := unmarshalH264SPS(proc.SPS)
+	if sps == nil {
+		return nil
+	}
+
+	metaData := &MetaData{
+		HasVideo:     true,
+		Height:       (sps.PicHeightInMapUnitsMinus1 + 1) * 16,
+		Width:        (sps.PicWidthInMbsMinus1 + 1) * 16,
+		VideoCodecID: CODEC_AVC,
+	}
+	// the frame rate is unknown when the first frame is a keyframe
+	if proc.deltaDTS > 0 {
+		metaData.FrameRate = uint32(time.Second / proc.deltaDTS)
+	}
+	proc.metaData.Reset()
+	metaData.WriteTo(proc.metaData)
+	metaDataPayload := proc.metaData.Bytes()
+	flvTag := &FlvTag{
+		TagType:   TAG_SCRIPT,
+		DataSize:  uint32(len(metaDataPayload)),
+		Timestamp: 0,
+		Data:      metaDataPayload,
+	}
+
+	if err := proc.nextProcess(flvTag); err != nil {
+		return err
+	}
+
+	record := &AVCDecoderConfigurationRecord{
+		ConfigurationVersion: 1,
+		AVCProfileIndication: proc.SPS[1],
+		ProfileCompatibility: proc.SPS[2],
+		AVCLevelIndication:   proc.SPS[3],
+		SPS:                  proc.SPS,
+		PPS:                  proc.PPS,
+	}
+	proc.avcDecoderConfigurationRecord.Reset()
+	record.WriteTo(proc.avcDecoderConfigurationRecord)
+	videoData := &VideoData{
+		FrameType:       FRAME_TYPE_KEY,
+		CodecID:         CODEC_AVC,
+		AVCPacketType:   AVC_SEQ_HEADER,
+		CompositionTime: cts,
+		Data:            proc.avcDecoderConfigurationRecord.Bytes(),
+	}
+	proc.videoData.Reset()
+	videoData.WriteTo(proc.videoData)
+	videoDataPayload := proc.videoData.Bytes()
+	proc.SPSSent = true
+
+	flvTag = &FlvTag{
+		TagType:   TAG_VIDEO,
+		DataSize:  uint32(len(videoDataPayload)),
+		Timestamp: dts,
+		Data:      videoDataPayload,
+	}
+	return proc.nextProcess(flvTag)
+}
+
 func (proc *flvMuxerProcessor) muxAudioPacket(packet *Packet, dts, pts uint32) []byte {
 	var audioDataPayload []byte
 
@@ -195,6 +231,13 @@ type FlvTag struct {
 	Data      []byte
 }
 
+// Clone returns a copy of flvTag owning its data.
+func (flvTag *FlvTag) Clone() *FlvTag {
+	clone := *flvTag
+	clone.Data = append([]byte(nil), flvTag.Data...)
+	return &clone
+}
+
 func (flvTag *FlvTag) WriteTo(writer io.Writer) (err error) {
 	if err = binary.Write(writer, binary.BigEndian, uint32(0)|(uint32(flvTag.TagType)<<24)|flvTag.DataSize); err != nil {
 		return err
@@ -221,6 +264,9 @@ type VideoData struct {
 	AVCPacketType   uint8
 	CompositionTime int32
 	Data            []byte
+	// NALs, when set with AVC_NALU, are written each with its length
+	// instead of Data.
+	NALs [][]byte
 }
 
 func (videoData *VideoData) WriteTo(writer io.Writer) (err error) {
@@ -230,6 +276,17 @@ func (videoData *VideoData) WriteTo(writer io.Writer) (err error) {
 	if err = binary.Write(writer, binary.BigEndian, int32(0)|(int32(videoData.AVCPacketType)<<24)|videoData.CompositionTime); err != nil {
 		return err
 	}
+	if videoData.AVCPacketType == AVC_NALU && videoData.NALs != nil {
+		for _, nal := range videoData.NALs {
+			if err = binary.Write(writer, binary.BigEndian, uint32(len(nal))); err != nil {
+				return err
+			}
+			if _, err = writer.Write(nal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	if videoData.AVCPacketType == AVC_NALU {
 		if err = binary.Write(writer, binary.BigEndian, uint32(len(videoData.Data))); err != nil {
 			return err
@@ -333,9 +390,11 @@ func (metaData *MetaData) WriteTo(writer amf.Writer) (err error) {
 		"hasVideo":     metaData.HasVideo,
 		"hasAudio":     metaData.HasAudio,
 		"canSeekToEnd": metaData.CanSeekToEnd,
-		"framerate":    metaData.FrameRate,
 		"videocodecid": metaData.VideoCodecID,
 	}
+	if metaData.FrameRate > 0 {
+		obj["framerate"] = metaData.FrameRate
+	}
 	if metaData.Width > 0 {
 		obj["width"] = metaData.Width
 	}
@@ -0,0 +1,54 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+type flvTagRecorder struct {
+	tags []*FlvTag
+}
+
+func (recorder *flvTagRecorder) Process(flvTag *FlvTag) error {
+	recorder.tags = append(recorder.tags, flvTag.Clone())
+	return nil
+}
+
+func (recorder *flvTagRecorder) Release() {}
+
+func TestFlvMuxerSendsFirstKeyframe(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	slice := []byte{0x41, 0x9a, 0x02, 0x00}
+
+	recorder := &flvTagRecorder{}
+	muxer := NewFlvMuxerProcessor()
+	muxer.Attach(recorder)
+
+	frames := []*Frame{
+		{Codec: CodecH264, Keyframe: true, NALs: [][]byte{sps, pps, idr}},
+		{Codec: CodecH264, DTS: 40 * time.Millisecond, PTS: 40 * time.Millisecond, NALs: [][]byte{slice}},
+	}
+	for _, frame := range frames {
+		if err := muxer.Process(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wantTypes := []uint8{TAG_SCRIPT, TAG_VIDEO, TAG_VIDEO, TAG_VIDEO}
+	if len(recorder.tags) != len(wantTypes) {
+		t.Fatalf("got %d tags, want %d", len(recorder.tags), len(wantTypes))
+	}
+	for i, tag := range recorder.tags {
+		if tag.TagType != wantTypes[i] {
+			t.Fatalf("tag %d: got type %d, want %d", i, tag.TagType, wantTypes[i])
+		}
+	}
+	if header := recorder.tags[1].Data; header[0] != FRAME_TYPE_KEY<<4|CODEC_AVC || header[1] != AVC_SEQ_HEADER {
+		t.Fatalf("tag 1 is not an avc sequence header: % x", header[:2])
+	}
+	if keyframe := recorder.tags[2].Data; keyframe[0] != FRAME_TYPE_KEY<<4|CODEC_AVC || keyframe[1] != AVC_NALU {
+		t.Fatalf("tag 2 is not the first keyframe: % x", keyframe[:2])
+	}
+}
@@ -0,0 +1,92 @@
+package rtp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Codec identifies the coding of a frame.
+type Codec uint8
+
+const (
+	CodecH264 Codec = iota + 1
+	CodecH265
+)
+
+func (codec Codec) String() string {
+	switch codec {
+	case CodecH264:
+		return "H264"
+	case CodecH265:
+		return "H265"
+	}
+	return fmt.Sprintf("Codec(%d)", uint8(codec))
+}
+
+// videoClockRate is the RTP and MPEG-PS clock rate of video.
+const videoClockRate = 90000
+
+// Frame is an access unit: the NAL units of one picture, without start
+// codes. A frame and its NAL units are only valid during Process, stages
+// keeping them must Clone it.
+type Frame struct {
+	Codec Codec
+	// PTS and DTS are relative to the first frame of the stream.
+	PTS      time.Duration
+	DTS      time.Duration
+	Keyframe bool
+	NALs     [][]byte
+	// Timestamp is the RTP timestamp of the frame.
+	Timestamp uint32
+	// Wallclock is the sender time of the frame mapped by RTCP sender
+	// reports, it is zero until a sender report is received.
+	Wallclock time.Time
+}
+
+// Clone returns a deep copy of frame.
+func (frame *Frame) Clone() *Frame {
+	clone := *frame
+	size := 0
+	for _, nal := range frame.NALs {
+		size += len(nal)
+	}
+	buf := make([]byte, 0, size)
+	clone.NALs = make([][]byte, len(frame.NALs))
+	for i, nal := range frame.NALs {
+		buf = append(buf, nal...)
+		clone.NALs[i] = buf[len(buf)-len(nal):]
+	}
+	return &clone
+}
+
+// timestampUnwrapper extends a timestamp wrapping at bits into the count
+// of ticks since the first timestamp.
+type timestampUnwrapper struct {
+	bits    uint
+	started bool
+	last    uint64
+	ticks   int64
+}
+
+func (unwrapper *timestampUnwrapper) unwrap(ts uint64) int64 {
+	mask := uint64(1)<<unwrapper.bits - 1
+	ts &= mask
+	if !unwrapper.started {
+		unwrapper.started = true
+		unwrapper.last = ts
+		return 0
+	}
+	unwrapper.ticks += signExtend((ts-unwrapper.last)&mask, unwrapper.bits)
+	unwrapper.last = ts
+	return unwrapper.ticks
+}
+
+// signExtend interprets the low bits of v as a two's complement number.
+func signExtend(v uint64, bits uint) int64 {
+	shift := 64 - bits
+	return int64(v<<shift) >> shift
+}
+
+func ticksToDuration(ticks int64, clockRate int64) time.Duration {
+	return time.Duration(ticks/clockRate)*time.Second + time.Duration(ticks%clockRate)*time.Second/time.Duration(clockRate)
+}
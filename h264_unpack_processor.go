@@ -1,26 +1,30 @@
 package rtp
 
 import (
-	"bytes"
-	"log"
-	"sync"
+	"encoding/binary"
+	"log/slog"
 )
 
 type h264UnpackProcessor struct {
-	next Processor
-	mux  sync.Mutex
+	next   Stage[*Frame]
+	logger *slog.Logger
+	// onKeyframe is called for every IDR frame
+	onKeyframe func()
 
-	fragments    []*Packet
-	fragmentsLen int
+	au *accessUnit
 }
 
-func NewH264UnpackProcessor() Processor {
+// NewH264UnpackProcessor returns a depacketizer of H.264 as described in
+// RFC 6184, emitting a frame per access unit.
+func NewH264UnpackProcessor() Depacketizer {
 	return &h264UnpackProcessor{
-		fragments: make([]*Packet, 100),
+		au:     newAccessUnit(CodecH264),
+		logger: logger,
 	}
 }
 
-func (proc *h264UnpackProcessor) Attach(next Processor) {
+func (proc *h264UnpackProcessor) Attach(next Stage[*Frame]) {
+	setLogger(next, proc.logger)
 	old := proc.next
 	proc.next = next
 	if old != nil {
@@ -28,6 +32,15 @@ func (proc *h264UnpackProcessor) Attach(next Processor) {
 	}
 }
 
+func (proc *h264UnpackProcessor) SetLogger(logger *slog.Logger) {
+	proc.logger = logger
+	setLogger(proc.next, logger)
+}
+
+func (proc *h264UnpackProcessor) SetKeyframeFunc(fn func()) {
+	proc.onKeyframe = fn
+}
+
 func (proc *h264UnpackProcessor) Release() {
 	next := proc.next
 	if next != nil {
@@ -35,49 +48,82 @@ func (proc *h264UnpackProcessor) Release() {
 	}
 }
 
-func (proc *h264UnpackProcessor) Process(packet interface{}) error {
-	pkt, _ := packet.(*Packet)
+// Gap drops the access unit being assembled.
+func (proc *h264UnpackProcessor) Gap(gap Gap) {
+	proc.au.reset()
+}
+
+// Flush emits the access unit being assembled, which has not seen its
+// marker.
+func (proc *h264UnpackProcessor) Flush() error {
+	if err := proc.emit(); err != nil {
+		return err
+	}
+	return flush(proc.next)
+}
+
+func (proc *h264UnpackProcessor) Process(pkt *Packet) error {
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+
+	au := proc.au
+	if !au.empty() && pkt.Timestamp != au.timestamp {
+		// the marker of the previous access unit was lost
+		if err := proc.emit(); err != nil {
+			return err
+		}
+	}
+	au.begin(pkt)
+
 	header := pkt.Payload[0]
 	switch header & 31 {
+	// STAP-A
+	case 24:
+		for b := pkt.Payload[1:]; len(b) > 2; {
+			size := int(binary.BigEndian.Uint16(b))
+			if size == 0 || size > len(b)-2 {
+				break
+			}
+			nal := b[2 : 2+size]
+			au.appendNAL(nal, nal[0]&31 == 5)
+			b = b[2+size:]
+		}
 	// FU-A
 	case 28:
-		fuheader := pkt.Payload[1]
-		if (fuheader>>7)&1 == 1 {
-			// Start
-			proc.fragmentsLen = 0
-		}
-
-		if proc.fragmentsLen != 0 && proc.fragments[proc.fragmentsLen-1].SequenceNumber != pkt.SequenceNumber-1 {
-			log.Println("h264 unpack process: packet loss?")
-			proc.fragmentsLen = 0
+		if len(pkt.Payload) < 2 {
 			return nil
 		}
-
-		proc.fragments[proc.fragmentsLen] = pkt
-		proc.fragmentsLen++
-
-		if (fuheader>>6)&1 == 1 {
-			buf := bytes.NewBuffer(make([]byte, 0, 1024*1024))
-			buf.WriteByte(0 | (header & 96) | (fuheader & 31))
-
-			for i := 0; i < proc.fragmentsLen; i++ {
-				buf.Write(proc.fragments[i].Payload[2:])
-			}
-			pkt.Payload = buf.Bytes()
-			proc.fragmentsLen = 0
-			return proc.nextProcess(pkt)
+		fuheader := pkt.Payload[1]
+		if fuheader&0x80 != 0 {
+			au.startFragment(pkt.SequenceNumber, []byte{header&0xE0 | fuheader&31}, pkt.Payload[2:])
+		} else if !au.appendFragment(pkt.SequenceNumber, pkt.Payload[2:]) {
+			proc.logger.Debug("h264 unpack process: packet loss?", "seq", pkt.SequenceNumber)
+		}
+		if fuheader&0x40 != 0 && au.fragment {
+			au.endFragment(fuheader&31 == 5)
 		}
 	default:
-		proc.fragmentsLen = 0
-		return proc.nextProcess(pkt)
+		au.appendNAL(pkt.Payload, header&31 == 5)
+	}
+
+	if pkt.Marker {
+		return proc.emit()
 	}
 	return nil
 }
 
-func (proc *h264UnpackProcessor) nextProcess(pkt interface{}) error {
+func (proc *h264UnpackProcessor) emit() error {
+	frame := proc.au.take()
+	if frame == nil {
+		return nil
+	}
+	if frame.Keyframe && proc.onKeyframe != nil {
+		proc.onKeyframe()
+	}
 	next := proc.next
 	if next != nil {
-		return next.Process(pkt)
+		return next.Process(frame)
 	}
 	return nil
 }
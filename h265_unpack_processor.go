@@ -0,0 +1,174 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"log/slog"
+)
+
+type h265UnpackProcessor struct {
+	next   Stage[*Frame]
+	logger *slog.Logger
+	// onKeyframe is called for every IRAP frame
+	onKeyframe func()
+	// donl is set when packets carry decoding order numbers
+	donl bool
+
+	au *accessUnit
+}
+
+// NewH265UnpackProcessor returns a depacketizer of H.265 as described in
+// RFC 7798, emitting a frame per access unit. donl must be set when the
+// stream carries DONL fields, i.e. sprop-max-don-diff is greater than 0.
+func NewH265UnpackProcessor(donl bool) Depacketizer {
+	return &h265UnpackProcessor{
+		au:     newAccessUnit(CodecH265),
+		donl:   donl,
+		logger: logger,
+	}
+}
+
+func (proc *h265UnpackProcessor) Attach(next Stage[*Frame]) {
+	setLogger(next, proc.logger)
+	old := proc.next
+	proc.next = next
+	if old != nil {
+		old.Release()
+	}
+}
+
+func (proc *h265UnpackProcessor) SetLogger(logger *slog.Logger) {
+	proc.logger = logger
+	setLogger(proc.next, logger)
+}
+
+func (proc *h265UnpackProcessor) SetKeyframeFunc(fn func()) {
+	proc.onKeyframe = fn
+}
+
+func (proc *h265UnpackProcessor) Release() {
+	next := proc.next
+	if next != nil {
+		next.Release()
+	}
+}
+
+// Gap drops the access unit being assembled.
+func (proc *h265UnpackProcessor) Gap(gap Gap) {
+	proc.au.reset()
+}
+
+// Flush emits the access unit being assembled, which has not seen its
+// marker.
+func (proc *h265UnpackProcessor) Flush() error {
+	if err := proc.emit(); err != nil {
+		return err
+	}
+	return flush(proc.next)
+}
+
+func (proc *h265UnpackProcessor) Process(pkt *Packet) error {
+	if len(pkt.Payload) < 3 {
+		return nil
+	}
+
+	au := proc.au
+	if !au.empty() && pkt.Timestamp != au.timestamp {
+		// the marker of the previous access unit was lost
+		if err := proc.emit(); err != nil {
+			return err
+		}
+	}
+	au.begin(pkt)
+
+	header := pkt.Payload[:2]
+	switch h265NALType(header[0]) {
+	// AP
+	case 48:
+		b := pkt.Payload[2:]
+		for first := true; ; first = false {
+			// DONL of the first NAL unit, DOND of the others
+			if proc.donl {
+				if first {
+					b = skipBytes(b, 2)
+				} else {
+					b = skipBytes(b, 1)
+				}
+			}
+			if len(b) <= 2 {
+				break
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			if size < 2 || size > len(b)-2 {
+				break
+			}
+			nal := b[2 : 2+size]
+			au.appendNAL(nal, h265Keyframe(h265NALType(nal[0])))
+			b = b[2+size:]
+		}
+	// FU
+	case 49:
+		fuheader := pkt.Payload[2]
+		typ := fuheader & 0x3f
+		data := pkt.Payload[3:]
+		if fuheader&0x80 != 0 {
+			if proc.donl {
+				data = skipBytes(data, 2)
+			}
+			au.startFragment(pkt.SequenceNumber, []byte{header[0]&0x81 | typ<<1, header[1]}, data)
+		} else if !au.appendFragment(pkt.SequenceNumber, data) {
+			proc.logger.Debug("h265 unpack process: packet loss?", "seq", pkt.SequenceNumber)
+		}
+		if fuheader&0x40 != 0 && au.fragment {
+			au.endFragment(h265Keyframe(typ))
+		}
+	// PACI
+	case 50:
+		proc.logger.Debug("h265 unpack process: PACI packet not supported", "seq", pkt.SequenceNumber)
+	default:
+		keyframe := h265Keyframe(h265NALType(header[0]))
+		if !proc.donl {
+			au.appendNAL(pkt.Payload, keyframe)
+		} else if len(pkt.Payload) > 4 {
+			// the NAL unit is its header followed by the data after DONL
+			au.startFragment(pkt.SequenceNumber, header, pkt.Payload[4:])
+			au.endFragment(keyframe)
+		}
+	}
+
+	if pkt.Marker {
+		return proc.emit()
+	}
+	return nil
+}
+
+func (proc *h265UnpackProcessor) emit() error {
+	frame := proc.au.take()
+	if frame == nil {
+		return nil
+	}
+	if frame.Keyframe && proc.onKeyframe != nil {
+		proc.onKeyframe()
+	}
+	next := proc.next
+	if next != nil {
+		return next.Process(frame)
+	}
+	return nil
+}
+
+func h265NALType(b byte) uint8 {
+	return (b >> 1) & 0x3f
+}
+
+// h265Keyframe tells if typ is an IRAP picture: BLA, IDR or CRA.
+func h265Keyframe(typ uint8) bool {
+	return typ >= 16 && typ <= 21
+}
+
+// skipBytes returns b without its first n bytes, or nil if it is shorter.
+func skipBytes(b []byte, n int) []byte {
+	if len(b) < n {
+		return nil
+	}
+	return b[n:]
+}
@@ -0,0 +1,121 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+)
+
+// frameCollector keeps a copy of every frame it receives.
+type frameCollector struct {
+	frames []*Frame
+}
+
+func (collector *frameCollector) Process(frame *Frame) error {
+	collector.frames = append(collector.frames, frame.Clone())
+	return nil
+}
+
+func (collector *frameCollector) Release() {}
+
+func TestH265UnpackProcessor(t *testing.T) {
+	var (
+		vps   = []byte{0x40, 0x01, 0xA1}
+		sps   = []byte{0x42, 0x01, 0xA2}
+		idr   = []byte{0x26, 0x01, 0xB1, 0xB2, 0xB3}
+		trail = []byte{0x02, 0x01, 0xC1}
+	)
+	type packet struct {
+		seq     uint16
+		ts      uint32
+		marker  bool
+		payload []byte
+	}
+	type frame struct {
+		ts       uint32
+		keyframe bool
+		nals     [][]byte
+	}
+	tests := []struct {
+		name    string
+		donl    bool
+		packets []packet
+		// gapAfter is the number of packets after which a Gap is reported
+		gapAfter int
+		frames   []frame
+	}{
+		{"single nal", false, []packet{
+			{1, 3000, true, trail},
+		}, 0, []frame{{3000, false, [][]byte{trail}}}},
+		{"aggregation", false, []packet{
+			{1, 3000, false, []byte{0x60, 0x01, 0, 3, 0x40, 0x01, 0xA1, 0, 3, 0x42, 0x01, 0xA2}},
+			{2, 3000, true, idr},
+		}, 0, []frame{{3000, true, [][]byte{vps, sps, idr}}}},
+		{"fragmentation", false, []packet{
+			{1, 3000, false, []byte{0x62, 0x01, 0x93, 0xB1}},
+			{2, 3000, false, []byte{0x62, 0x01, 0x13, 0xB2}},
+			{3, 3000, true, []byte{0x62, 0x01, 0x53, 0xB3}},
+		}, 0, []frame{{3000, true, [][]byte{idr}}}},
+		{"lost fragment", false, []packet{
+			{1, 3000, false, trail},
+			{2, 3000, false, []byte{0x62, 0x01, 0x93, 0xB1}},
+			{4, 3000, true, []byte{0x62, 0x01, 0x53, 0xB3}},
+		}, 0, []frame{{3000, false, [][]byte{trail}}}},
+		{"lost marker", false, []packet{
+			{1, 3000, false, trail},
+			{2, 6000, true, idr},
+		}, 0, []frame{{3000, false, [][]byte{trail}}, {6000, true, [][]byte{idr}}}},
+		{"gap", false, []packet{
+			{1, 3000, false, trail},
+			{5, 3000, true, idr},
+		}, 1, []frame{{3000, true, [][]byte{idr}}}},
+		{"donl single nal", true, []packet{
+			{1, 3000, true, []byte{0x02, 0x01, 0, 9, 0xC1}},
+		}, 0, []frame{{3000, false, [][]byte{trail}}}},
+		{"donl aggregation", true, []packet{
+			{1, 3000, false, []byte{0x60, 0x01, 0, 5, 0, 3, 0x40, 0x01, 0xA1, 0, 0, 3, 0x42, 0x01, 0xA2}},
+			{2, 3000, true, []byte{0x26, 0x01, 0, 6, 0xB1, 0xB2, 0xB3}},
+		}, 0, []frame{{3000, true, [][]byte{vps, sps, idr}}}},
+		{"donl fragmentation", true, []packet{
+			{1, 3000, false, []byte{0x62, 0x01, 0x93, 0, 7, 0xB1, 0xB2}},
+			{2, 3000, true, []byte{0x62, 0x01, 0x53, 0xB3}},
+		}, 0, []frame{{3000, true, [][]byte{idr}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			collector := &frameCollector{}
+			proc := NewH265UnpackProcessor(test.donl)
+			proc.Attach(collector)
+			keyframes := 0
+			setKeyframeFunc(proc, func() { keyframes++ })
+
+			for i, p := range test.packets {
+				if test.gapAfter > 0 && i == test.gapAfter {
+					proc.(GapHandler).Gap(Gap{SequenceNumber: test.packets[i-1].seq + 1, Count: p.seq - test.packets[i-1].seq - 1})
+				}
+				pkt := &Packet{SequenceNumber: p.seq, Timestamp: p.ts, Marker: p.marker, Payload: p.payload}
+				if err := proc.Process(pkt); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(collector.frames) != len(test.frames) {
+				t.Fatalf("got %d frames, want %d", len(collector.frames), len(test.frames))
+			}
+			wantKeyframes := 0
+			for i, want := range test.frames {
+				got := collector.frames[i]
+				if got.Codec != CodecH265 || got.Timestamp != want.ts || got.Keyframe != want.keyframe || !reflect.DeepEqual(got.NALs, want.nals) {
+					t.Fatalf("frame %d: got %v ts %d keyframe %v nals %x, want ts %d keyframe %v nals %x",
+						i, got.Codec, got.Timestamp, got.Keyframe, got.NALs, want.ts, want.keyframe, want.nals)
+				}
+				if want.keyframe {
+					wantKeyframes++
+				}
+			}
+			if keyframes != wantKeyframes {
+				t.Fatalf("got %d keyframe calls, want %d", keyframes, wantKeyframes)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package rtp
+
+import "time"
+
+const (
+	defaultJitterBufferCap = uint16(512)
+	defaultJitterTarget    = 40 * time.Millisecond
+	defaultJitterMax       = 400 * time.Millisecond
+
+	// jitterMultiplier scales the measured interarrival jitter into the
+	// time a hole is waited for.
+	jitterMultiplier = 3
+)
+
+const (
+	pushInSequence = iota
+	pushDuplicate
+	pushLate
+	// pushResync is returned for a packet outside the buffer window, the
+	// buffer has to be drained before restarting on it.
+	pushResync
+)
+
+// jitterBuffer reorders the packets of a session. Packets are released in
+// sequence order as soon as they are contiguous; a hole is waited for until
+// the deadline of the first packet buffered after it, derived from its
+// arrival time and the measured jitter, then skipped. The head slot always
+// holds seq.
+type jitterBuffer struct {
+	pkts     []*Packet
+	nackTime []time.Time
+	cap      uint16
+	offset   uint16
+	len      uint16
+	seq      uint16
+	started  bool
+
+	clockRate uint32
+	target    time.Duration
+	max       time.Duration
+	delay     time.Duration
+	// nackTimeout extends the wait for a hole whose retransmission was
+	// requested, up to max.
+	nackTimeout time.Duration
+
+	// newest is the RTP timestamp of the last buffered packet.
+	newest uint32
+}
+
+func newJitterBuffer(clockRate uint32, target, max, nackTimeout time.Duration) *jitterBuffer {
+	if target <= 0 {
+		target = defaultJitterTarget
+	}
+	if max < target {
+		max = defaultJitterMax
+		if max < target {
+			max = target
+		}
+	}
+	return &jitterBuffer{
+		pkts:        make([]*Packet, defaultJitterBufferCap),
+		nackTime:    make([]time.Time, defaultJitterBufferCap),
+		cap:         defaultJitterBufferCap,
+		clockRate:   clockRate,
+		target:      target,
+		max:         max,
+		delay:       target,
+		nackTimeout: nackTimeout,
+	}
+}
+
+// push stores pkt and returns its offset from the head slot.
+func (jb *jitterBuffer) push(pkt *Packet) (result int, offset uint16) {
+	if !jb.started {
+		jb.started = true
+		jb.seq = pkt.SequenceNumber
+	}
+
+	offset = pkt.SequenceNumber - jb.seq
+	switch {
+	case offset > ^uint16(0)-maxMisorder:
+		return pushLate, offset
+	case offset >= jb.cap:
+		return pushResync, offset
+	}
+
+	slot := (jb.offset + offset) % jb.cap
+	if jb.pkts[slot] != nil {
+		return pushDuplicate, offset
+	}
+	jb.pkts[slot] = pkt
+	if offset+1 > jb.len {
+		jb.len = offset + 1
+		jb.newest = pkt.Timestamp
+	}
+	return pushInSequence, offset
+}
+
+// pop returns the head packet, or nil if the buffer is empty or starts
+// with a hole.
+func (jb *jitterBuffer) pop() (pkt *Packet) {
+	if jb.len == 0 || jb.pkts[jb.offset] == nil {
+		return nil
+	}
+	pkt = jb.pkts[jb.offset]
+	jb.advance()
+	return pkt
+}
+
+// skip gives up the holes at the head of the buffer and returns the first
+// skipped sequence number and the number of skipped packets.
+func (jb *jitterBuffer) skip() (seq uint16, count uint16) {
+	seq = jb.seq
+	for jb.len > 0 && jb.pkts[jb.offset] == nil {
+		jb.advance()
+		count++
+	}
+	return seq, count
+}
+
+func (jb *jitterBuffer) advance() {
+	jb.pkts[jb.offset] = nil
+	jb.nackTime[jb.offset] = time.Time{}
+	jb.offset++
+	if jb.offset == jb.cap {
+		jb.offset = 0
+	}
+	jb.len--
+	jb.seq++
+}
+
+// reset restarts an empty buffer at seq.
+func (jb *jitterBuffer) reset(seq uint16) {
+	jb.offset = 0
+	jb.len = 0
+	jb.seq = seq
+	jb.started = true
+}
+
+// deadline returns when the hole at the head of the buffer is skipped.
+func (jb *jitterBuffer) deadline() (deadline time.Time, ok bool) {
+	if jb.len == 0 || jb.pkts[jb.offset] != nil {
+		return deadline, false
+	}
+
+	var next *Packet
+	for i := uint16(1); i < jb.len; i++ {
+		if next = jb.pkts[(jb.offset+i)%jb.cap]; next != nil {
+			break
+		}
+	}
+	if next == nil {
+		return deadline, false
+	}
+
+	// The buffered packets already span more than the maximum latency.
+	if jb.clockRate > 0 && int64(int32(jb.newest-next.Timestamp)) >= int64(jb.max)*int64(jb.clockRate)/int64(time.Second) {
+		return next.arrival, true
+	}
+
+	deadline = next.arrival.Add(jb.delay)
+	if requested := jb.nackTime[jb.offset]; !requested.IsZero() && requested.Add(jb.nackTimeout).After(deadline) {
+		deadline = requested.Add(jb.nackTimeout)
+	}
+	if limit := next.arrival.Add(jb.max); deadline.After(limit) {
+		deadline = limit
+	}
+	return deadline, true
+}
+
+// adapt sizes the wait for holes from the measured interarrival jitter.
+func (jb *jitterBuffer) adapt(jitter time.Duration) {
+	delay := jitter * jitterMultiplier
+	switch {
+	case delay < jb.target:
+		delay = jb.target
+	case delay > jb.max:
+		delay = jb.max
+	}
+	jb.delay = delay
+}
+
+// missing marks the holes before offset that were not requested yet and
+// returns their sequence numbers.
+func (jb *jitterBuffer) missing(offset uint16, now time.Time) (lost []uint16) {
+	for i := uint16(0); i < offset; i++ {
+		slot := (jb.offset + i) % jb.cap
+		if jb.pkts[slot] == nil && jb.nackTime[slot].IsZero() {
+			jb.nackTime[slot] = now
+			lost = append(lost, jb.seq+i)
+		}
+	}
+	return lost
+}
@@ -0,0 +1,88 @@
+package rtp
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+type metricsHandler struct {
+	srv *Server
+}
+
+// NewMetricsHandler returns an http.Handler exposing the server and
+// session counters in the Prometheus text exposition format.
+func NewMetricsHandler(srv *Server) http.Handler {
+	return &metricsHandler{srv: srv}
+}
+
+func (handler *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(w)
+	defer writer.Flush()
+
+	srv := handler.srv
+	sessions := srv.Sessions()
+
+	writeMetric(writer, "rtp_sessions_active", "gauge", "Number of active sessions.", float64(len(sessions)))
+	writeMetric(writer, "rtp_sessions_accepted_total", "counter", "Number of accepted sessions.", float64(atomic.LoadUint64(&srv.acceptedSessions)))
+	writeMetric(writer, "rtp_sessions_rejected_total", "counter", "Number of sessions dropped before being accepted.", float64(atomic.LoadUint64(&srv.rejectedSessions)))
+	writeMetric(writer, "rtp_packets_rejected_total", "counter", "Number of packets rejected by the admission policy.", float64(atomic.LoadUint64(&srv.rejectedPackets)))
+	writeMetric(writer, "rtp_ssrc_collisions_total", "counter", "Number of packets dropped for a known SSRC received from another address.", float64(atomic.LoadUint64(&srv.ssrcCollisions)))
+	writeMetric(writer, "rtp_packets_malformed_total", "counter", "Number of packets that failed to unmarshal.", float64(atomic.LoadUint64(&srv.malformedPackets)))
+	writeMetric(writer, "rtp_packets_version_mismatch_total", "counter", "Number of packets dropped for an unsupported rtp version.", float64(atomic.LoadUint64(&srv.versionMismatches)))
+	writeMetric(writer, "rtp_packets_dropped_total", "counter", "Number of packets dropped because a session receive channel was full.", float64(atomic.LoadUint64(&srv.droppedPackets)))
+	writeMetric(writer, "rtp_processor_errors_total", "counter", "Number of sessions terminated by a processor error.", float64(atomic.LoadUint64(&srv.processorErrors)))
+
+	// the pipeline stages are not bound to a server, their counters sum
+	// the stages of every server of the process
+	writeProcessMetric(writer, "rtp_rtmp_publish_failures_total", "counter", "Number of failed rtmp connects and publishes.", float64(atomic.LoadUint64(&rtmpPublishFailures)))
+	writeProcessMetric(writer, "rtp_async_queue_depth", "gauge", "Number of values queued by async stages and tee branches.", float64(atomic.LoadInt64(&asyncQueued)))
+	writeProcessMetric(writer, "rtp_async_dropped_total", "counter", "Number of values dropped by async stages and tee branches with a full queue.", float64(atomic.LoadUint64(&asyncDropped)))
+
+	stats := make([]SessionStats, len(sessions))
+	for i, sess := range sessions {
+		stats[i] = sess.Stats()
+	}
+
+	sessionMetrics := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(stats *SessionStats) float64
+	}{
+		{"rtp_session_packets_received_total", "counter", "Number of packets received by the session.", func(stats *SessionStats) float64 { return float64(stats.PacketsReceived) }},
+		{"rtp_session_bytes_received_total", "counter", "Number of payload bytes received by the session.", func(stats *SessionStats) float64 { return float64(stats.BytesReceived) }},
+		{"rtp_session_packets_lost", "gauge", "Number of packets lost by the session.", func(stats *SessionStats) float64 { return float64(stats.PacketsLost) }},
+		{"rtp_session_packets_reordered_total", "counter", "Number of packets received out of order.", func(stats *SessionStats) float64 { return float64(stats.PacketsReordered) }},
+		{"rtp_session_packets_duplicated_total", "counter", "Number of duplicated packets.", func(stats *SessionStats) float64 { return float64(stats.PacketsDuplicated) }},
+		{"rtp_session_packets_late_total", "counter", "Number of packets dropped for arriving too late.", func(stats *SessionStats) float64 { return float64(stats.PacketsLateDropped) }},
+		{"rtp_session_packets_dropped_total", "counter", "Number of packets dropped because the receive channel was full.", func(stats *SessionStats) float64 { return float64(stats.PacketsDropped) }},
+		{"rtp_session_jitter_seconds", "gauge", "Interarrival jitter of the session.", func(stats *SessionStats) float64 { return stats.Jitter.Seconds() }},
+		{"rtp_session_bitrate_bps", "gauge", "Payload bitrate of the session.", func(stats *SessionStats) float64 { return float64(stats.Bitrate) }},
+	}
+	for _, metric := range sessionMetrics {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.typ)
+		for i, sess := range sessions {
+			fmt.Fprintf(writer, "%s{ssrc=\"%d\",remote_addr=\"%s\"} %v\n", metric.name, sess.SSRC(), escapeLabelValue(sess.Addr().String()), metric.value(&stats[i]))
+		}
+	}
+}
+
+func writeMetric(writer *bufio.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+}
+
+// writeProcessMetric writes a metric counted for the whole process rather
+// than for the server, labeled scope="process".
+func writeProcessMetric(writer *bufio.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(writer, "# HELP %s %s Counted for the whole process.\n# TYPE %s %s\n%s{scope=\"process\"} %v\n", name, help, name, typ, name, value)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
@@ -3,9 +3,25 @@ package rtp
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"sync"
+	"time"
 )
 
+var ErrShortBuffer = fmt.Errorf("buffer too short for rtp packet")
+var ErrExtensionSize = fmt.Errorf("rtp header extension size is not a multiple of 4")
+var ErrExtensionInvalid = fmt.Errorf("rtp header extension is invalid")
+var ErrPaddingInvalid = fmt.Errorf("rtp padding size exceeds payload")
+
+// Header extension profiles defined by RFC 8285. The low 4 bits of the
+// two-byte profile are application bits and are ignored when matching.
+const (
+	ExtensionProfileOneByte = 0xBEDE
+	ExtensionProfileTwoByte = 0x1000
+)
+
+const rtpHeaderLen = 12
+
 type Packet struct {
 	Version        uint8
 	Padding        bool
@@ -18,8 +34,26 @@ type Packet struct {
 	CSRCList       []uint32
 	Payload        []byte
 
-	pool *sync.Pool
-	buf  []byte
+	// ExtensionProfile and ExtensionPayload hold the header extension
+	// when Extension is set. ExtensionPayload length must be a multiple of 4.
+	ExtensionProfile uint16
+	ExtensionPayload []byte
+
+	// Extensions holds the elements of an RFC 8285 one-byte or two-byte
+	// header extension. It is empty for other profiles.
+	Extensions []ExtensionElement
+
+	// PaddingSize is the number of padding octets, including the last
+	// count octet, appended when Padding is set.
+	PaddingSize uint8
+
+	pool     *sync.Pool
+	buf      []byte
+	arrival  time.Time
+	extended uint32
+	// wallclock is the sender time of the packet, set by the session
+	// from RTCP sender reports
+	wallclock time.Time
 }
 
 func newPacket(pool *sync.Pool) *Packet {
@@ -29,54 +63,348 @@ func newPacket(pool *sync.Pool) *Packet {
 	}
 }
 
+// ExtendedSequenceNumber returns the sequence number extended with the
+// count of wraparounds, as described in RFC 3550 appendix A.1. It is only
+// set on packets delivered by a session.
+func (packet *Packet) ExtendedSequenceNumber() uint32 {
+	return packet.extended
+}
+
+// Clone returns a deep copy of packet, which is not returned to the
+// packet pool.
+func (packet *Packet) Clone() *Packet {
+	clone := *packet
+	clone.pool = nil
+	clone.buf = nil
+	clone.CSRCList = append([]uint32(nil), packet.CSRCList...)
+	clone.Payload = append([]byte(nil), packet.Payload...)
+	clone.ExtensionPayload = append([]byte(nil), packet.ExtensionPayload...)
+	if packet.Extensions != nil {
+		clone.Extensions = make([]ExtensionElement, len(packet.Extensions))
+		for i, elem := range packet.Extensions {
+			clone.Extensions[i] = ExtensionElement{ID: elem.ID, Data: append([]byte(nil), elem.Data...)}
+		}
+	}
+	return &clone
+}
+
 func (packet *Packet) release() {
 	if packet.pool != nil {
 		packet.pool.Put(packet)
 	}
 }
 
+// unmarshal copies b into the packet buffer and parses it.
 func (packet *Packet) unmarshal(b []byte) (err error) {
-	reader := bytes.NewReader(b)
+	if cap(packet.buf) < len(b) {
+		packet.buf = make([]byte, len(b))
+	}
+	n := copy(packet.buf[:cap(packet.buf)], b)
+	return packet.parse(packet.buf[:n])
+}
 
-	var first32 uint32
-	err = binary.Read(reader, binary.BigEndian, &first32)
-	if err != nil {
-		return err
+// parse decodes b in place, the fields of the packet reference b.
+func (packet *Packet) parse(b []byte) (err error) {
+	if len(b) < rtpHeaderLen {
+		return ErrShortBuffer
 	}
 
 	// Unmarshal first 32 bits
+	first32 := binary.BigEndian.Uint32(b)
 	packet.Version = uint8(first32 >> 30)
 	packet.Padding = (first32 >> 29 & 1) > 0
 	packet.Extension = (first32 >> 28 & 1) > 0
-	CSRCCount := first32 >> 24 & 15
+	CSRCCount := int(first32 >> 24 & 15)
 	packet.Marker = (first32 >> 23 & 1) > 0
 	packet.PayloadType = uint8(first32 >> 16 & 127)
 	packet.SequenceNumber = uint16(first32 & 65535)
 
-	// Unmarshal timestamp
-	err = binary.Read(reader, binary.BigEndian, &packet.Timestamp)
-	if err != nil {
-		return err
-	}
+	// Unmarshal timestamp and SSRC
+	packet.Timestamp = binary.BigEndian.Uint32(b[4:])
+	packet.SSRC = binary.BigEndian.Uint32(b[8:])
+	offset := rtpHeaderLen
 
-	// Unmrashal SSRC
-	err = binary.Read(reader, binary.BigEndian, &packet.SSRC)
-	if err != nil {
-		return err
+	// Unmarshal CSRC list
+	if len(b) < offset+CSRCCount*4 {
+		return ErrShortBuffer
+	}
+	packet.CSRCList = packet.CSRCList[:0]
+	for i := 0; i < CSRCCount; i++ {
+		packet.CSRCList = append(packet.CSRCList, binary.BigEndian.Uint32(b[offset:]))
+		offset += 4
 	}
 
-	// Unmarshal CSRC list
-	packet.CSRCList = make([]uint32, CSRCCount)
-	for i := 0; i < int(CSRCCount); i++ {
-		err = binary.Read(reader, binary.BigEndian, &packet.CSRCList[i])
-		if err != nil {
-			return err
+	// Unmarshal header extension
+	extensionLen := 0
+	packet.ExtensionProfile = 0
+	if packet.Extension {
+		if len(b) < offset+4 {
+			return ErrExtensionInvalid
+		}
+		packet.ExtensionProfile = binary.BigEndian.Uint16(b[offset:])
+		extensionLen = int(binary.BigEndian.Uint16(b[offset+2:])) * 4
+		offset += 4
+		if offset+extensionLen > len(b) {
+			return ErrExtensionInvalid
 		}
 	}
 
 	// Unmarshal payload
-	packet.Payload = packet.buf[:reader.Len()]
-	reader.Read(packet.Payload)
+	packet.ExtensionPayload = b[offset : offset+extensionLen]
+	packet.Payload = b[offset+extensionLen:]
+
+	// Strip padding, the last octet counts the padding octets including itself
+	packet.PaddingSize = 0
+	if packet.Padding {
+		if len(packet.Payload) == 0 {
+			return ErrPaddingInvalid
+		}
+		paddingSize := packet.Payload[len(packet.Payload)-1]
+		if paddingSize == 0 || int(paddingSize) > len(packet.Payload) {
+			return ErrPaddingInvalid
+		}
+		packet.PaddingSize = paddingSize
+		packet.Payload = packet.Payload[:len(packet.Payload)-int(paddingSize)]
+	}
+
+	packet.Extensions = packet.Extensions[:0]
+	switch {
+	case !packet.Extension:
+	case packet.ExtensionProfile == ExtensionProfileOneByte:
+		packet.Extensions, err = parseOneByteExtensions(packet.ExtensionPayload, packet.Extensions)
+	case packet.ExtensionProfile&0xFFF0 == ExtensionProfileTwoByte:
+		packet.Extensions, err = parseTwoByteExtensions(packet.ExtensionPayload, packet.Extensions)
+	}
+
+	return err
+}
+
+// ExtensionElement is a single RFC 8285 header extension element.
+type ExtensionElement struct {
+	ID   uint8
+	Data []byte
+}
+
+// IsOneByteExtension reports whether the packet carries an RFC 8285
+// one-byte header extension.
+func (packet *Packet) IsOneByteExtension() bool {
+	return packet.Extension && packet.ExtensionProfile == ExtensionProfileOneByte
+}
+
+// IsTwoByteExtension reports whether the packet carries an RFC 8285
+// two-byte header extension.
+func (packet *Packet) IsTwoByteExtension() bool {
+	return packet.Extension && packet.ExtensionProfile&0xFFF0 == ExtensionProfileTwoByte
+}
+
+// GetExtension returns the data of the RFC 8285 element with the given id,
+// or nil if the packet does not carry it.
+func (packet *Packet) GetExtension(id uint8) []byte {
+	for _, elem := range packet.Extensions {
+		if elem.ID == id {
+			return elem.Data
+		}
+	}
+	return nil
+}
+
+// SetExtensions encodes elems as an RFC 8285 header extension using the
+// one-byte form when every element fits, and the two-byte form otherwise.
+func (packet *Packet) SetExtensions(elems []ExtensionElement) error {
+	oneByte := true
+	for _, elem := range elems {
+		if elem.ID == 0 || elem.ID > 14 || len(elem.Data) == 0 || len(elem.Data) > 16 {
+			oneByte = false
+		}
+		if elem.ID == 0 || len(elem.Data) > 255 {
+			return ErrExtensionInvalid
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if oneByte {
+		packet.ExtensionProfile = ExtensionProfileOneByte
+		for _, elem := range elems {
+			buf.WriteByte(elem.ID<<4 | uint8(len(elem.Data)-1))
+			buf.Write(elem.Data)
+		}
+	} else {
+		packet.ExtensionProfile = ExtensionProfileTwoByte
+		for _, elem := range elems {
+			buf.WriteByte(elem.ID)
+			buf.WriteByte(uint8(len(elem.Data)))
+			buf.Write(elem.Data)
+		}
+	}
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
 
+	packet.Extension = true
+	packet.ExtensionPayload = buf.Bytes()
+	packet.Extensions = append(packet.Extensions[:0], elems...)
 	return nil
 }
+
+func parseOneByteExtensions(b []byte, elems []ExtensionElement) ([]ExtensionElement, error) {
+	for i := 0; i < len(b); {
+		id := b[i] >> 4
+		if id == 0 {
+			// padding
+			i++
+			continue
+		}
+		if id == 15 {
+			// reserved, stop processing
+			break
+		}
+		l := int(b[i]&15) + 1
+		i++
+		if i+l > len(b) {
+			return elems, ErrExtensionInvalid
+		}
+		elems = append(elems, ExtensionElement{ID: id, Data: b[i : i+l]})
+		i += l
+	}
+	return elems, nil
+}
+
+func parseTwoByteExtensions(b []byte, elems []ExtensionElement) ([]ExtensionElement, error) {
+	for i := 0; i < len(b); {
+		id := b[i]
+		if id == 0 {
+			// padding
+			i++
+			continue
+		}
+		if i+1 >= len(b) {
+			return elems, ErrExtensionInvalid
+		}
+		l := int(b[i+1])
+		i += 2
+		if i+l > len(b) {
+			return elems, ErrExtensionInvalid
+		}
+		elems = append(elems, ExtensionElement{ID: id, Data: b[i : i+l]})
+		i += l
+	}
+	return elems, nil
+}
+
+// MarshalSize returns the number of bytes the packet occupies on the wire.
+func (packet *Packet) MarshalSize() int {
+	size := rtpHeaderLen + len(packet.CSRCList)*4 + len(packet.Payload)
+	if packet.Extension {
+		size += 4 + len(packet.ExtensionPayload)
+	}
+	if packet.Padding {
+		size += int(packet.PaddingSize)
+	}
+	return size
+}
+
+// Marshal returns the wire format of the packet.
+func (packet *Packet) Marshal() ([]byte, error) {
+	b := make([]byte, packet.MarshalSize())
+	n, err := packet.MarshalTo(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// MarshalTo writes the wire format of the packet into b and returns the
+// number of bytes written.
+func (packet *Packet) MarshalTo(b []byte) (n int, err error) {
+	size := packet.MarshalSize()
+	if len(b) < size {
+		return 0, ErrShortBuffer
+	}
+	if packet.Extension && len(packet.ExtensionPayload)%4 != 0 {
+		return 0, ErrExtensionSize
+	}
+	if len(packet.CSRCList) > 15 {
+		return 0, fmt.Errorf("rtp csrc count %d exceeds 15", len(packet.CSRCList))
+	}
+
+	// Marshal first 32 bits
+	first32 := uint32(packet.Version&3) << 30
+	if packet.Padding && packet.PaddingSize > 0 {
+		first32 |= 1 << 29
+	}
+	if packet.Extension {
+		first32 |= 1 << 28
+	}
+	first32 |= uint32(len(packet.CSRCList)) << 24
+	if packet.Marker {
+		first32 |= 1 << 23
+	}
+	first32 |= uint32(packet.PayloadType&127) << 16
+	first32 |= uint32(packet.SequenceNumber)
+	binary.BigEndian.PutUint32(b[0:], first32)
+	binary.BigEndian.PutUint32(b[4:], packet.Timestamp)
+	binary.BigEndian.PutUint32(b[8:], packet.SSRC)
+	n = rtpHeaderLen
+
+	// Marshal CSRC list
+	for _, csrc := range packet.CSRCList {
+		binary.BigEndian.PutUint32(b[n:], csrc)
+		n += 4
+	}
+
+	// Marshal header extension
+	if packet.Extension {
+		binary.BigEndian.PutUint16(b[n:], packet.ExtensionProfile)
+		binary.BigEndian.PutUint16(b[n+2:], uint16(len(packet.ExtensionPayload)/4))
+		n += 4
+		n += copy(b[n:], packet.ExtensionPayload)
+	}
+
+	// Marshal payload
+	n += copy(b[n:], packet.Payload)
+
+	// Marshal padding
+	if packet.Padding && packet.PaddingSize > 0 {
+		for i := 0; i < int(packet.PaddingSize)-1; i++ {
+			b[n] = 0
+			n++
+		}
+		b[n] = packet.PaddingSize
+		n++
+	}
+
+	return n, nil
+}
+
+// PacketBuilder generates a sequence of RTP packets for one SSRC.
+type PacketBuilder struct {
+	PayloadType    uint8
+	SSRC           uint32
+	CSRCList       []uint32
+	SequenceNumber uint16
+}
+
+func NewPacketBuilder(ssrc uint32, payloadType uint8, seq uint16) *PacketBuilder {
+	return &PacketBuilder{
+		PayloadType:    payloadType,
+		SSRC:           ssrc,
+		SequenceNumber: seq,
+	}
+}
+
+// Build returns a version 2 packet carrying payload and advances the
+// sequence number. The payload is not copied.
+func (builder *PacketBuilder) Build(payload []byte, timestamp uint32, marker bool) *Packet {
+	packet := &Packet{
+		Version:        2,
+		Marker:         marker,
+		PayloadType:    builder.PayloadType,
+		SequenceNumber: builder.SequenceNumber,
+		Timestamp:      timestamp,
+		SSRC:           builder.SSRC,
+		CSRCList:       builder.CSRCList,
+		Payload:        payload,
+	}
+	builder.SequenceNumber++
+	return packet
+}
@@ -0,0 +1,193 @@
+package rtp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     Packet
+		extensions []ExtensionElement
+		size       int
+	}{
+		{"plain", Packet{
+			Version: 2, PayloadType: 96, SequenceNumber: 65535, Timestamp: 0xFFFFFFFF, SSRC: 1,
+			Payload: []byte{1, 2, 3},
+		}, nil, 15},
+		{"marker and csrc", Packet{
+			Version: 2, Marker: true, PayloadType: 127, SequenceNumber: 1, Timestamp: 3000, SSRC: 2,
+			CSRCList: []uint32{3, 4}, Payload: []byte{1},
+		}, nil, 21},
+		{"padding", Packet{
+			Version: 2, Padding: true, PaddingSize: 4, PayloadType: 96, SSRC: 3,
+			Payload: []byte{1, 2, 3, 4, 5},
+		}, nil, 21},
+		{"raw extension", Packet{
+			Version: 2, PayloadType: 96, SSRC: 4,
+			Extension: true, ExtensionProfile: 0x1234, ExtensionPayload: []byte{1, 2, 3, 4},
+			Payload: []byte{1},
+		}, nil, 21},
+		{"one-byte extensions", Packet{
+			Version: 2, PayloadType: 96, SSRC: 5, Payload: []byte{1},
+		}, []ExtensionElement{
+			{ID: 1, Data: []byte{0xAA}},
+			{ID: 14, Data: bytes.Repeat([]byte{0xBB}, 16)},
+		}, 37},
+		{"two-byte extensions", Packet{
+			Version: 2, PayloadType: 96, SSRC: 6, Payload: []byte{1},
+		}, []ExtensionElement{
+			{ID: 1, Data: []byte{0xAA}},
+			{ID: 15, Data: bytes.Repeat([]byte{0xBB}, 17)},
+		}, 41},
+		{"two-byte empty extension", Packet{
+			Version: 2, PayloadType: 96, SSRC: 7, CSRCList: []uint32{8}, Padding: true, PaddingSize: 1,
+		}, []ExtensionElement{
+			{ID: 2, Data: []byte{}},
+		}, 25},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.packet
+			if test.extensions != nil {
+				if err := want.SetExtensions(test.extensions); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := want.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != test.size || want.MarshalSize() != test.size {
+				t.Fatalf("got %d bytes, marshal size %d, want %d", len(b), want.MarshalSize(), test.size)
+			}
+
+			got := &Packet{}
+			if err := got.unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+			if got.Version != want.Version || got.Padding != want.Padding || got.Extension != want.Extension ||
+				got.Marker != want.Marker || got.PayloadType != want.PayloadType ||
+				got.SequenceNumber != want.SequenceNumber || got.Timestamp != want.Timestamp || got.SSRC != want.SSRC {
+				t.Fatalf("got header %+v, want %+v", got, &want)
+			}
+			if len(got.CSRCList) != len(want.CSRCList) {
+				t.Fatalf("got csrc %v, want %v", got.CSRCList, want.CSRCList)
+			}
+			for i := range want.CSRCList {
+				if got.CSRCList[i] != want.CSRCList[i] {
+					t.Fatalf("got csrc %v, want %v", got.CSRCList, want.CSRCList)
+				}
+			}
+			if !bytes.Equal(got.Payload, want.Payload) || got.PaddingSize != want.PaddingSize {
+				t.Fatalf("got payload %v padding %d, want %v %d", got.Payload, got.PaddingSize, want.Payload, want.PaddingSize)
+			}
+			if got.ExtensionProfile != want.ExtensionProfile || !bytes.Equal(got.ExtensionPayload, want.ExtensionPayload) {
+				t.Fatalf("got extension %#x %v, want %#x %v", got.ExtensionProfile, got.ExtensionPayload, want.ExtensionProfile, want.ExtensionPayload)
+			}
+			if len(got.Extensions) != len(test.extensions) {
+				t.Fatalf("got extensions %v, want %v", got.Extensions, test.extensions)
+			}
+			for _, elem := range test.extensions {
+				if data := got.GetExtension(elem.ID); !bytes.Equal(data, elem.Data) {
+					t.Fatalf("got extension %d data %v, want %v", elem.ID, data, elem.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestPacketExtensionForm(t *testing.T) {
+	packet := &Packet{}
+	packet.SetExtensions([]ExtensionElement{{ID: 14, Data: make([]byte, 16)}})
+	if !packet.IsOneByteExtension() || packet.IsTwoByteExtension() {
+		t.Fatalf("got profile %#x, want one-byte", packet.ExtensionProfile)
+	}
+	packet.SetExtensions([]ExtensionElement{{ID: 1, Data: make([]byte, 17)}})
+	if packet.IsOneByteExtension() || !packet.IsTwoByteExtension() {
+		t.Fatalf("got profile %#x, want two-byte", packet.ExtensionProfile)
+	}
+
+	for _, elems := range [][]ExtensionElement{
+		{{ID: 0, Data: []byte{1}}},
+		{{ID: 1, Data: make([]byte, 256)}},
+	} {
+		if err := packet.SetExtensions(elems); !errors.Is(err, ErrExtensionInvalid) {
+			t.Fatalf("got %v, want %v", err, ErrExtensionInvalid)
+		}
+	}
+}
+
+func TestPacketOneByteExtensionPadding(t *testing.T) {
+	// padding between the elements, then the reserved id 15 ends them
+	b := []byte{
+		0x90, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1,
+		0xBE, 0xDE, 0, 2,
+		0x10, 0xAA, 0, 0x21,
+		0xBB, 0xCC, 0xF0, 0x30,
+	}
+	packet := &Packet{}
+	if err := packet.unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Extensions) != 2 || !bytes.Equal(packet.GetExtension(1), []byte{0xAA}) || !bytes.Equal(packet.GetExtension(2), []byte{0xBB, 0xCC}) {
+		t.Fatalf("got extensions %v", packet.Extensions)
+	}
+}
+
+func TestPacketUnmarshalMalformed(t *testing.T) {
+	header := []byte{0x80, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1}
+	with := func(first byte, rest ...byte) []byte {
+		b := append([]byte{first}, header[1:]...)
+		return append(b, rest...)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"short header", header[:11], ErrShortBuffer},
+		{"short csrc list", with(0x82, 0, 0, 0, 1), ErrShortBuffer},
+		{"short extension header", with(0x90, 0xBE, 0xDE, 0), ErrExtensionInvalid},
+		{"short extension", with(0x90, 0xBE, 0xDE, 0, 2, 0, 0, 0, 0), ErrExtensionInvalid},
+		{"one-byte element overrun", with(0x90, 0xBE, 0xDE, 0, 1, 0x13, 0, 0, 0), ErrExtensionInvalid},
+		{"two-byte element without length", with(0x90, 0x10, 0x00, 0, 1, 0, 0, 0, 1), ErrExtensionInvalid},
+		{"two-byte element overrun", with(0x90, 0x10, 0x00, 0, 1, 1, 3, 0, 0), ErrExtensionInvalid},
+		{"padding without payload", with(0xA0), ErrPaddingInvalid},
+		{"zero padding", with(0xA0, 1, 0), ErrPaddingInvalid},
+		{"padding exceeds payload", with(0xA0, 1, 3), ErrPaddingInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := &Packet{}
+			if err := packet.unmarshal(test.b); !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPacketMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet Packet
+		size   int
+	}{
+		{"short buffer", Packet{Version: 2, Payload: []byte{1}}, rtpHeaderLen},
+		{"extension size", Packet{Version: 2, Extension: true, ExtensionPayload: []byte{1}}, 100},
+		{"csrc count", Packet{Version: 2, CSRCList: make([]uint32, 16)}, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.packet.MarshalTo(make([]byte, test.size)); err == nil {
+				t.Fatal("marshal succeeded")
+			}
+		})
+	}
+}
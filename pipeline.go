@@ -0,0 +1,415 @@
+package rtp
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownStage  = fmt.Errorf("unknown pipeline stage")
+	ErrStageMismatch = fmt.Errorf("pipeline stage type mismatch")
+)
+
+// MediaType names the values flowing between pipeline stages. The frames
+// of a codec have their own type, so a muxer only follows a depacketizer of
+// a codec it supports.
+type MediaType string
+
+const (
+	MediaPacket MediaType = "packet"
+	// MediaFrame is consumed by stages accepting the frames of any codec,
+	// and produced by stages whose codec is unknown.
+	MediaFrame     MediaType = "frame"
+	MediaH264Frame MediaType = "frame/h264"
+	MediaH265Frame MediaType = "frame/h265"
+	MediaFlvTag    MediaType = "flv"
+)
+
+// accepts tells if a stage consuming typ accepts the values of in.
+func (typ MediaType) accepts(in MediaType) bool {
+	return typ == in || typ == MediaFrame && in.valueType() == MediaFrame
+}
+
+// valueType returns the type the values of typ are passed as, MediaFrame
+// for the frames of every codec.
+func (typ MediaType) valueType() MediaType {
+	if strings.HasPrefix(string(typ), string(MediaFrame)+"/") {
+		return MediaFrame
+	}
+	return typ
+}
+
+// StageFactory builds a stage of a pipeline. In is the type the stage
+// consumes and Out the type it produces, Out is empty for a sink.
+type StageFactory struct {
+	In  MediaType
+	Out MediaType
+	// New returns a Stage of In which, unless the stage is a sink, has an
+	// Attach method taking a Stage of Out.
+	New func(arg string) (interface{}, error)
+}
+
+// PipelineConfig describes a chain of stages, e.g. decoded from JSON or
+// YAML. The first stage consumes RTP packets.
+type PipelineConfig struct {
+	Stages []StageConfig `json:"stages" yaml:"stages"`
+}
+
+// StageConfig describes a stage of a pipeline.
+type StageConfig struct {
+	// Name is the registered name of the stage, "tee" to feed every
+	// pipeline of Branches, or "async" to queue the values of the next
+	// stage, see Async.
+	Name string `json:"name" yaml:"name"`
+	// Arg is passed to the factory, e.g. the url of an rtmp stage. It is
+	// the policy of an async stage, which defaults to block.
+	Arg      string           `json:"arg,omitempty" yaml:"arg,omitempty"`
+	Branches []PipelineConfig `json:"branches,omitempty" yaml:"branches,omitempty"`
+}
+
+// Registry holds the stage factories pipelines are built from.
+type Registry struct {
+	mux       sync.RWMutex
+	factories map[string]StageFactory
+}
+
+// DefaultRegistry holds the stages of this package: ps, h264, h265, whose
+// arg is donl when the stream carries DONL fields, flv, which muxes H.264
+// frames, and rtmp, whose arg is the url of the stream, e.g.
+// rtmp://host/app/stream.
+var DefaultRegistry = NewRegistry()
+
+func init() {
+	DefaultRegistry.Register("ps", StageFactory{In: MediaPacket, Out: MediaH264Frame, New: func(arg string) (interface{}, error) {
+		return NewPSUnpackProcessor(), nil
+	}})
+	DefaultRegistry.Register("h264", StageFactory{In: MediaPacket, Out: MediaH264Frame, New: func(arg string) (interface{}, error) {
+		return NewH264UnpackProcessor(), nil
+	}})
+	DefaultRegistry.Register("h265", StageFactory{In: MediaPacket, Out: MediaH265Frame, New: func(arg string) (interface{}, error) {
+		if arg != "" && arg != "donl" {
+			return nil, fmt.Errorf("h265 arg %q is not donl", arg)
+		}
+		return NewH265UnpackProcessor(arg == "donl"), nil
+	}})
+	DefaultRegistry.Register("flv", StageFactory{In: MediaH264Frame, Out: MediaFlvTag, New: func(arg string) (interface{}, error) {
+		return NewFlvMuxerProcessor(), nil
+	}})
+	DefaultRegistry.Register("rtmp", StageFactory{In: MediaFlvTag, New: newRTMPStage})
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]StageFactory)}
+}
+
+// Register adds or replaces the factory of the stage name.
+func (registry *Registry) Register(name string, factory StageFactory) {
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+	registry.factories[name] = factory
+}
+
+func (registry *Registry) factory(name string) (StageFactory, bool) {
+	registry.mux.RLock()
+	defer registry.mux.RUnlock()
+	factory, ok := registry.factories[name]
+	return factory, ok
+}
+
+// Build validates config and builds its stages, returning the first one.
+// Nothing is built when a stage is unknown or consumes a type its
+// previous stage does not produce.
+func (registry *Registry) Build(config PipelineConfig) (Processor, error) {
+	if err := registry.validate(config, MediaPacket); err != nil {
+		return nil, err
+	}
+	head, err := registry.build(config, MediaPacket)
+	if err != nil {
+		return nil, err
+	}
+	return head.(Processor), nil
+}
+
+// BuildString builds a pipeline described as in ParsePipeline.
+func (registry *Registry) BuildString(desc string) (Processor, error) {
+	config, err := ParsePipeline(desc)
+	if err != nil {
+		return nil, err
+	}
+	return registry.Build(config)
+}
+
+// validate checks that every stage of config exists and consumes the type
+// produced by the previous one, starting with in.
+func (registry *Registry) validate(config PipelineConfig, in MediaType) error {
+	if len(config.Stages) == 0 {
+		return fmt.Errorf("pipeline is empty")
+	}
+
+	typ := in
+	for i, stage := range config.Stages {
+		if typ == "" {
+			return fmt.Errorf("%w: %s follows a sink", ErrStageMismatch, stage.Name)
+		}
+		if stage.Name == "tee" {
+			if i != len(config.Stages)-1 {
+				return fmt.Errorf("%w: tee must be the last stage", ErrStageMismatch)
+			}
+			if _, ok := teeFactories[typ.valueType()]; !ok {
+				return fmt.Errorf("%w: tee of %s", ErrStageMismatch, typ)
+			}
+			if len(stage.Branches) == 0 {
+				return fmt.Errorf("pipeline tee has no branch")
+			}
+			for _, branch := range stage.Branches {
+				if err := registry.validate(branch, typ); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if stage.Name == "async" {
+			if _, ok := asyncFactories[typ.valueType()]; !ok {
+				return fmt.Errorf("%w: async of %s", ErrStageMismatch, typ)
+			}
+			policy, err := parseAsyncArg(stage.Arg)
+			if err != nil {
+				return err
+			}
+			if policy == AsyncDropUntilKeyframe && typ == MediaPacket {
+				return fmt.Errorf("%w: async %s of %s", ErrStageMismatch, policy, typ)
+			}
+			continue
+		}
+
+		factory, ok := registry.factory(stage.Name)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownStage, stage.Name)
+		}
+		if !factory.In.accepts(typ) {
+			return fmt.Errorf("%w: %s consumes %s, not %s", ErrStageMismatch, stage.Name, factory.In, typ)
+		}
+		typ = factory.Out
+	}
+	if typ != "" {
+		return fmt.Errorf("%w: pipeline ends with %s producing %s", ErrStageMismatch, config.Stages[len(config.Stages)-1].Name, typ)
+	}
+	return nil
+}
+
+// build creates the stages of a validated config from the last one, so a
+// failure only releases the stages already attached.
+func (registry *Registry) build(config PipelineConfig, in MediaType) (next interface{}, err error) {
+	types := make([]MediaType, len(config.Stages))
+	typ := in
+	for i, stage := range config.Stages {
+		types[i] = typ
+		if stage.Name != "tee" && stage.Name != "async" {
+			factory, _ := registry.factory(stage.Name)
+			typ = factory.Out
+		}
+	}
+
+	defer func() {
+		if err != nil && next != nil {
+			next.(interface{ Release() }).Release()
+		}
+	}()
+	for i := len(config.Stages) - 1; i >= 0; i-- {
+		stage := config.Stages[i]
+		var current interface{}
+		switch stage.Name {
+		case "tee":
+			current, err = registry.buildTee(stage, types[i])
+		case "async":
+			policy, _ := parseAsyncArg(stage.Arg)
+			current = asyncFactories[types[i].valueType()](policy)
+		default:
+			factory, _ := registry.factory(stage.Name)
+			current, err = factory.New(stage.Arg)
+		}
+		if err != nil {
+			return next, fmt.Errorf("pipeline stage %s: %w", stage.Name, err)
+		}
+
+		if next != nil {
+			if err = attachStages[types[i+1].valueType()](current, next); err != nil {
+				current.(interface{ Release() }).Release()
+				return next, err
+			}
+		}
+		next = current
+	}
+	return next, nil
+}
+
+func (registry *Registry) buildTee(stage StageConfig, typ MediaType) (interface{}, error) {
+	tee, add := teeFactories[typ.valueType()]()
+	for i, config := range stage.Branches {
+		branch, err := registry.build(config, typ)
+		if err != nil {
+			tee.(interface{ Release() }).Release()
+			return nil, err
+		}
+		if err = add(fmt.Sprint(i), branch); err != nil {
+			branch.(interface{ Release() }).Release()
+			tee.(interface{ Release() }).Release()
+			return nil, err
+		}
+	}
+	return tee, nil
+}
+
+var attachStages = map[MediaType]func(prev, next interface{}) error{
+	MediaPacket: attachStage[*Packet],
+	MediaFrame:  attachStage[*Frame],
+	MediaFlvTag: attachStage[*FlvTag],
+}
+
+func attachStage[T any](prev, next interface{}) error {
+	source, ok := prev.(interface{ Attach(next Stage[T]) })
+	if !ok {
+		return fmt.Errorf("%w: %T can't attach a stage of %T", ErrStageMismatch, prev, *new(T))
+	}
+	sink, ok := next.(Stage[T])
+	if !ok {
+		return fmt.Errorf("%w: %T is not a stage of %T", ErrStageMismatch, next, *new(T))
+	}
+	source.Attach(sink)
+	return nil
+}
+
+var teeFactories = map[MediaType]func() (tee interface{}, add func(name string, next interface{}) error){
+	MediaPacket: newTeeStage[*Packet],
+	MediaFrame:  newTeeStage[*Frame],
+	MediaFlvTag: newTeeStage[*FlvTag],
+}
+
+func newTeeStage[T interface{ Clone() T }]() (interface{}, func(name string, next interface{}) error) {
+	tee := NewTee[T](0)
+	return tee, func(name string, next interface{}) error {
+		stage, ok := next.(Stage[T])
+		if !ok {
+			return fmt.Errorf("%w: %T is not a stage of %T", ErrStageMismatch, next, *new(T))
+		}
+		return tee.Add(name, stage)
+	}
+}
+
+var asyncFactories = map[MediaType]func(policy AsyncPolicy) interface{}{
+	MediaPacket: newAsyncStage[*Packet],
+	MediaFrame:  newAsyncStage[*Frame],
+	MediaFlvTag: newAsyncStage[*FlvTag],
+}
+
+func newAsyncStage[T interface{ Clone() T }](policy AsyncPolicy) interface{} {
+	return NewAsync[T](0, policy)
+}
+
+func parseAsyncArg(arg string) (AsyncPolicy, error) {
+	if arg == "" {
+		return AsyncBlock, nil
+	}
+	return ParseAsyncPolicy(arg)
+}
+
+func newRTMPStage(arg string) (interface{}, error) {
+	appURL, name, err := splitRTMPURL(arg)
+	if err != nil {
+		return nil, err
+	}
+	return NewRTMPPublishProcessor(appURL, name)
+}
+
+// splitRTMPURL splits rtmp://host/app/stream?key=x into the url of the app
+// and the stream name, which keeps the query as most servers expect the
+// stream key there.
+func splitRTMPURL(arg string) (appURL, name string, err error) {
+	u, err := url.Parse(arg)
+	if err != nil {
+		return "", "", err
+	}
+	dir, name := path.Split(u.Path)
+	if name == "" {
+		return "", "", fmt.Errorf("rtmp url %q has no stream name", arg)
+	}
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	u.Path = strings.TrimSuffix(dir, "/")
+	u.RawQuery = ""
+	return u.String(), name, nil
+}
+
+// ParsePipeline parses a pipeline described as stages separated by "->".
+// A stage is a registered name, a url whose scheme is the stage name and
+// which is passed as arg, a name followed by its arg in parentheses, or
+// tee(...) listing branch pipelines separated by ",", e.g.
+//
+//	ps -> flv -> tee(rtmp://a/live/cam1, async(drop-oldest) -> rtmp://b/live/cam1)
+func ParsePipeline(desc string) (config PipelineConfig, err error) {
+	tokens, err := splitTopLevel(desc, "->")
+	if err != nil {
+		return config, err
+	}
+
+	for _, token := range tokens {
+		token = strings.TrimSpace(token)
+		var stage StageConfig
+		switch {
+		case token == "":
+			return config, fmt.Errorf("pipeline %q has an empty stage", desc)
+		case strings.HasPrefix(token, "tee(") && strings.HasSuffix(token, ")"):
+			branches, err := splitTopLevel(token[len("tee("):len(token)-1], ",")
+			if err != nil {
+				return config, err
+			}
+			stage.Name = "tee"
+			for _, branch := range branches {
+				branchConfig, err := ParsePipeline(branch)
+				if err != nil {
+					return config, err
+				}
+				stage.Branches = append(stage.Branches, branchConfig)
+			}
+		case strings.Contains(token, "://"):
+			stage.Name = token[:strings.Index(token, "://")]
+			stage.Arg = token
+		case strings.HasSuffix(token, ")") && strings.Contains(token, "("):
+			open := strings.Index(token, "(")
+			stage.Name = strings.TrimSpace(token[:open])
+			stage.Arg = strings.TrimSpace(token[open+1 : len(token)-1])
+		default:
+			stage.Name = token
+		}
+		config.Stages = append(config.Stages, stage)
+	}
+	return config, nil
+}
+
+// splitTopLevel splits s around sep outside of parentheses.
+func splitTopLevel(s, sep string) (parts []string, err error) {
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("pipeline %q has unbalanced parentheses", s)
+			}
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("pipeline %q has unbalanced parentheses", s)
+	}
+	return append(parts, s[start:]), nil
+}
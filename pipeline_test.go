@@ -0,0 +1,74 @@
+package rtp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSplitRTMPURL(t *testing.T) {
+	tests := []struct {
+		arg  string
+		url  string
+		name string
+	}{
+		{"rtmp://host/app/stream", "rtmp://host/app", "stream"},
+		{"rtmp://host:1935/app/stream?key=x", "rtmp://host:1935/app", "stream?key=x"},
+		{"rtmp://host/app/inst/stream?key=x&t=1", "rtmp://host/app/inst", "stream?key=x&t=1"},
+	}
+	for _, test := range tests {
+		url, name, err := splitRTMPURL(test.arg)
+		if err != nil {
+			t.Fatalf("%s: %v", test.arg, err)
+		}
+		if url != test.url || name != test.name {
+			t.Fatalf("%s: got %s %s, want %s %s", test.arg, url, name, test.url, test.name)
+		}
+	}
+
+	if _, _, err := splitRTMPURL("rtmp://host/app/"); err == nil {
+		t.Fatal("url without stream name accepted")
+	}
+}
+
+func TestRegistryValidateCodec(t *testing.T) {
+	tests := []struct {
+		desc  string
+		valid bool
+	}{
+		{"h264 -> flv -> rtmp://host/app/stream", true},
+		{"ps -> async(drop-until-keyframe) -> flv -> rtmp://host/app/stream", true},
+		{"h264 -> tee(flv -> rtmp://a/app/stream, flv -> rtmp://b/app/stream)", true},
+		{"h265 -> flv -> rtmp://host/app/stream", false},
+		{"h265 -> async -> flv -> rtmp://host/app/stream", false},
+		{"h265 -> tee(flv -> rtmp://host/app/stream)", false},
+	}
+	for _, test := range tests {
+		config, err := ParsePipeline(test.desc)
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		err = DefaultRegistry.validate(config, MediaPacket)
+		if test.valid && err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		if !test.valid && !errors.Is(err, ErrStageMismatch) {
+			t.Fatalf("%s: got %v, want %v", test.desc, err, ErrStageMismatch)
+		}
+	}
+}
+
+func TestRegistryFrameOfAnyCodec(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register("h265", StageFactory{In: MediaPacket, Out: MediaH265Frame, New: func(arg string) (interface{}, error) {
+		return NewH265UnpackProcessor(false), nil
+	}})
+	registry.Register("record", StageFactory{In: MediaFrame, New: func(arg string) (interface{}, error) {
+		return &frameRecorder{}, nil
+	}})
+
+	processor, err := registry.BuildString("h265 -> async -> tee(record, record)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor.Release()
+}
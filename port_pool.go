@@ -0,0 +1,153 @@
+package rtp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrPortPoolExhausted = fmt.Errorf("port pool exhausted")
+
+// PortPool hands out a dedicated listening port per stream. Every
+// allocation runs its own Server bound to a single expected session, and
+// the port returns to the pool when the session is closed.
+type PortPool struct {
+	// Host is the address the listeners bind to, empty for all addresses.
+	Host string
+	// MinPort and MaxPort bound the allocated ports, inclusive.
+	MinPort int
+	MaxPort int
+	// Network is "udp" or "tcp", it defaults to "udp".
+	Network string
+	// RTCP allocates even ports and receives RTCP on the following port.
+	RTCP bool
+	// ExpectTimeout closes an allocated session that received no packet
+	// within the timeout. Zero waits forever.
+	ExpectTimeout time.Duration
+	// Configure, when set, is called with every server before it serves,
+	// e.g. to set ActiveTimeout or Logger.
+	Configure func(srv *Server)
+
+	mux  sync.Mutex
+	used map[int]*Server
+	next int
+}
+
+// Allocate opens a listener on a free port and returns the session that
+// receives the first stream sent to it, processed by processor.
+func (pool *PortPool) Allocate(processor Processor) (sess *Session, port int, err error) {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+
+	if pool.MinPort <= 0 || pool.MaxPort < pool.MinPort || pool.MaxPort > 65535 {
+		return nil, 0, fmt.Errorf("port pool range %d-%d is invalid", pool.MinPort, pool.MaxPort)
+	}
+	if pool.used == nil {
+		pool.used = make(map[int]*Server)
+	}
+
+	step := 1
+	if pool.RTCP {
+		step = 2
+	}
+	count := (pool.MaxPort - pool.MinPort + 1) / step
+	for i := 0; i < count; i++ {
+		port = pool.MinPort + (pool.next+i)%count*step
+		if pool.RTCP && port%2 != 0 {
+			port++
+		}
+		if port+step-1 > pool.MaxPort || pool.used[port] != nil {
+			continue
+		}
+
+		srv := pool.newServer(port)
+		if err = srv.Serve(); err != nil {
+			// the port is taken by another process
+			continue
+		}
+		sess, err = srv.expectAny(processor)
+		if err != nil {
+			srv.Close()
+			return nil, 0, err
+		}
+		pool.used[port] = srv
+		pool.next = (pool.next + i + 1) % count
+		go pool.watch(port, srv, sess)
+		return sess, port, nil
+	}
+	return nil, 0, ErrPortPoolExhausted
+}
+
+func (pool *PortPool) newServer(port int) *Server {
+	srv := &Server{
+		Addr:    net.JoinHostPort(pool.Host, strconv.Itoa(port)),
+		Network: pool.Network,
+	}
+	if pool.RTCP {
+		srv.RTCPAddr = net.JoinHostPort(pool.Host, strconv.Itoa(port+1))
+	}
+	if pool.Configure != nil {
+		pool.Configure(srv)
+	}
+	// only the expected session is admitted
+	srv.Admission = AdmitFunc(func(srv *Server, ssrc uint32, raddr net.Addr) bool {
+		return false
+	})
+	return srv
+}
+
+// watch releases port once sess is closed.
+func (pool *PortPool) watch(port int, srv *Server, sess *Session) {
+	var timeout <-chan time.Time
+	if pool.ExpectTimeout > 0 {
+		timer := time.NewTimer(pool.ExpectTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-sess.closed:
+	case <-timeout:
+		if srv.SessionCount() == 0 {
+			sess.log().Warn("expected session receive nothing, will be closed", "port", port)
+			sess.terminate(ErrSessionTimeout)
+		}
+		<-sess.closed
+	}
+
+	srv.Close()
+	pool.mux.Lock()
+	if pool.used[port] == srv {
+		delete(pool.used, port)
+	}
+	pool.mux.Unlock()
+}
+
+// InUse returns the number of allocated ports.
+func (pool *PortPool) InUse() int {
+	pool.mux.Lock()
+	defer pool.mux.Unlock()
+	return len(pool.used)
+}
+
+// Close closes every allocated session and its listener.
+func (pool *PortPool) Close() {
+	pool.mux.Lock()
+	servers := make([]*Server, 0, len(pool.used))
+	for _, srv := range pool.used {
+		servers = append(servers, srv)
+	}
+	pool.mux.Unlock()
+
+	for _, srv := range servers {
+		for _, sess := range srv.Sessions() {
+			sess.Close()
+		}
+		srv.expected.Range(func(key interface{}, val interface{}) bool {
+			val.(*Session).Close()
+			return true
+		})
+	}
+}
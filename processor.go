@@ -1,7 +1,82 @@
 package rtp
 
-type Processor interface {
-	Process(pkt interface{}) error
-	Attach(p Processor)
+import "log/slog"
+
+// Stage is a step of a media pipeline consuming values of type T: RTP
+// packets, frames or FLV tags. Release releases the stage and the stages
+// after it.
+type Stage[T any] interface {
+	Process(v T) error
 	Release()
 }
+
+// Filter is a stage producing values of type Out for the next stage. The
+// type of Attach makes a chain wired to the wrong stage fail to compile.
+type Filter[In, Out any] interface {
+	Stage[In]
+	Attach(next Stage[Out])
+}
+
+// Processor is the first stage of a session, consuming its RTP packets in
+// sequence order.
+type Processor = Stage[*Packet]
+
+// Depacketizer turns the RTP packets of a session into frames.
+type Depacketizer = Filter[*Packet, *Frame]
+
+// Muxer turns frames into FLV tags.
+type Muxer = Filter[*Frame, *FlvTag]
+
+// loggerSetter is implemented by processors accepting the logger of the
+// session they are attached to. Implementations pass it on to the next
+// processor.
+type loggerSetter interface {
+	SetLogger(logger *slog.Logger)
+}
+
+func setLogger(p interface{}, logger *slog.Logger) {
+	if setter, ok := p.(loggerSetter); ok {
+		setter.SetLogger(logger)
+	}
+}
+
+// keyframeNotifier is implemented by processors detecting keyframes. The
+// session sets the function called on every keyframe, implementations pass
+// it on to the next processor.
+type keyframeNotifier interface {
+	SetKeyframeFunc(fn func())
+}
+
+func setKeyframeFunc(p interface{}, fn func()) {
+	if notifier, ok := p.(keyframeNotifier); ok {
+		notifier.SetKeyframeFunc(fn)
+	}
+}
+
+// Flusher is implemented by processors holding buffered output, e.g. a
+// partially assembled frame. Flush is called when the server shuts down
+// gracefully, implementations pass it on to the next processor.
+type Flusher interface {
+	Flush() error
+}
+
+func flush(p interface{}) error {
+	if flusher, ok := p.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Gap describes packets a session stopped waiting for.
+type Gap struct {
+	SSRC uint32
+	// SequenceNumber is the first skipped sequence number.
+	SequenceNumber uint16
+	Count          uint16
+}
+
+// GapHandler is implemented by processors notified of skipped packets,
+// e.g. to discard a partially received frame.
+type GapHandler interface {
+	Gap(gap Gap)
+}
@@ -3,8 +3,9 @@ package rtp
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"time"
 )
 
 var psHeaderLen = 14
@@ -18,23 +19,41 @@ var PackInvalidError = fmt.Errorf("pack is invalid")
 type psUnpackProcessor struct {
 	firstMainFrame     bool
 	buf                *bytes.Buffer
-	next               Processor
+	next               Stage[*Frame]
 	mux                sync.Mutex
 	lastSequenceNumber uint16
 	lastTimestamp      uint32
+	lastWallclock      time.Time
 	loss               bool
+	started            bool
 	h264Buf            *bytes.Buffer
+	logger             *slog.Logger
+	onKeyframe         func()
+
+	// pts and dts of the first PES of the pack, when hasPTS is set
+	hasPTS   bool
+	pts, dts uint64
+	pesClock timestampUnwrapper
+	rtpClock timestampUnwrapper
+	nals     [][]byte
+	frame    Frame
 }
 
-func NewPSUnpackProcessor() Processor {
+// NewPSUnpackProcessor returns a depacketizer of H.264 carried in MPEG-PS
+// over RTP, as GB28181 devices send, emitting a frame per pack.
+func NewPSUnpackProcessor() Depacketizer {
 	return &psUnpackProcessor{
 		firstMainFrame: false,
 		buf:            bytes.NewBuffer(make([]byte, 0, 1024*1024)),
 		h264Buf:        new(bytes.Buffer),
+		logger:         logger,
+		pesClock:       timestampUnwrapper{bits: 33},
+		rtpClock:       timestampUnwrapper{bits: 32},
 	}
 }
 
-func (proc *psUnpackProcessor) Attach(next Processor) {
+func (proc *psUnpackProcessor) Attach(next Stage[*Frame]) {
+	setLogger(next, proc.logger)
 	old := proc.next
 	proc.next = next
 	if old != nil {
@@ -42,6 +61,15 @@ func (proc *psUnpackProcessor) Attach(next Processor) {
 	}
 }
 
+func (proc *psUnpackProcessor) SetLogger(logger *slog.Logger) {
+	proc.logger = logger
+	setLogger(proc.next, logger)
+}
+
+func (proc *psUnpackProcessor) SetKeyframeFunc(fn func()) {
+	proc.onKeyframe = fn
+}
+
 func (proc *psUnpackProcessor) Release() {
 	next := proc.next
 	if next != nil {
@@ -49,24 +77,31 @@ func (proc *psUnpackProcessor) Release() {
 	}
 }
 
-func (proc *psUnpackProcessor) Process(packet interface{}) error {
-	pkt, _ := packet.(*Packet)
+// Gap drops the pack being assembled, unpacking resumes at the next pack.
+func (proc *psUnpackProcessor) Gap(gap Gap) {
+	proc.logger.Debug("ps gap, drop pack", "seq", gap.SequenceNumber, "count", gap.Count)
+	proc.loss = true
+}
 
+func (proc *psUnpackProcessor) Process(pkt *Packet) error {
 	defer func() {
 		proc.lastSequenceNumber = pkt.SequenceNumber
 		proc.lastTimestamp = pkt.Timestamp
+		proc.lastWallclock = pkt.wallclock
 	}()
 
-	if pkt.SequenceNumber-proc.lastSequenceNumber > 1 {
+	if !proc.started {
+		proc.started = true
+	} else if pkt.SequenceNumber-proc.lastSequenceNumber > 1 {
 		proc.loss = true
 	}
 
 	if proc.loss {
-		logger.Printf("ps loss, drop packet ssrc %v, seq %v, timestamp %v, mark %v\n", pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp, pkt.Marker)
+		proc.logger.Debug("ps loss, drop packet", "seq", pkt.SequenceNumber, "timestamp", pkt.Timestamp, "mark", pkt.Marker)
 		if pkt.Marker {
 			proc.loss = false
 			proc.buf.Reset()
-		} else if pkt.SequenceNumber-proc.lastSequenceNumber <= 1 && pkt.Timestamp > proc.lastTimestamp {
+		} else if pkt.SequenceNumber-proc.lastSequenceNumber <= 1 && int32(pkt.Timestamp-proc.lastTimestamp) > 0 {
 			proc.loss = false
 			proc.buf.Reset()
 			proc.buf.Write(pkt.Payload)
@@ -74,53 +109,81 @@ func (proc *psUnpackProcessor) Process(packet interface{}) error {
 		return nil
 	}
 
-	if pkt.Timestamp > proc.lastTimestamp && proc.buf.Len() > 0 {
-		defer proc.buf.Reset()
-		h264, err := proc.h264(proc.buf.Bytes())
-		if err != nil {
-			log.Printf("process unpack ps packet err %v, ssrc %v, seq %v, timestamp %v\n", err, pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp)
-		}
-
-		splits := bytes.Split(h264, []byte{0x00, 0x00, 0x00, 0x01})
-		for _, split := range splits {
-			if len(split) == 0 {
-				continue
-			}
-			pkt.Payload = split
-			if err = proc.nextProcess(pkt); err != nil {
-				return err
-			}
+	if int32(pkt.Timestamp-proc.lastTimestamp) > 0 && proc.buf.Len() > 0 {
+		// the marker of the previous pack was lost
+		if err := proc.unpack(proc.lastTimestamp, proc.lastWallclock); err != nil {
+			return err
 		}
-		return nil
 	}
 
 	proc.buf.Write(pkt.Payload)
 	if pkt.Marker {
-		defer proc.buf.Reset()
-		h264, err := proc.h264(proc.buf.Bytes())
-		if err != nil {
-			log.Println("process unpack ps packet err:", err)
-		}
+		return proc.unpack(pkt.Timestamp, pkt.wallclock)
+	}
+	return nil
+}
 
-		splits := bytes.Split(h264, []byte{0x00, 0x00, 0x00, 0x01})
-		for _, split := range splits {
-			if len(split) == 0 {
-				continue
-			}
-			pkt.Payload = split
-			if err = proc.nextProcess(pkt); err != nil {
-				return err
-			}
+// unpack sends the H.264 access unit of the buffered pack to the next
+// processor.
+func (proc *psUnpackProcessor) unpack(timestamp uint32, wallclock time.Time) error {
+	defer proc.buf.Reset()
+	h264, err := proc.h264(proc.buf.Bytes())
+	if err != nil {
+		proc.logger.Warn("process unpack ps packet failed", "timestamp", timestamp, "err", err)
+	}
+
+	keyframe := false
+	proc.nals = proc.nals[:0]
+	for _, split := range bytes.Split(h264, []byte{0x00, 0x00, 0x00, 0x01}) {
+		if len(split) == 0 {
+			continue
+		}
+		if split[0]&31 == 5 {
+			keyframe = true
 		}
+		proc.nals = append(proc.nals, split)
+	}
+	if len(proc.nals) == 0 {
 		return nil
 	}
-	return nil
+
+	frame := &proc.frame
+	*frame = Frame{
+		Codec:     CodecH264,
+		Keyframe:  keyframe,
+		NALs:      proc.nals,
+		Timestamp: timestamp,
+		Wallclock: wallclock,
+	}
+	if proc.hasPTS {
+		dts := proc.pesClock.unwrap(proc.dts)
+		frame.DTS = ticksToDuration(dts, videoClockRate)
+		frame.PTS = ticksToDuration(dts+signExtend((proc.pts-proc.dts)&(1<<33-1), 33), videoClockRate)
+	} else {
+		frame.PTS = ticksToDuration(proc.rtpClock.unwrap(uint64(timestamp)), videoClockRate)
+		frame.DTS = frame.PTS
+	}
+
+	if keyframe && proc.onKeyframe != nil {
+		proc.onKeyframe()
+	}
+	return proc.nextProcess(frame)
 }
 
-func (proc *psUnpackProcessor) nextProcess(pkt interface{}) error {
+// Flush unpacks the pack being assembled, which has not seen its marker.
+func (proc *psUnpackProcessor) Flush() error {
+	if !proc.loss && proc.buf.Len() > 0 {
+		if err := proc.unpack(proc.lastTimestamp, proc.lastWallclock); err != nil {
+			return err
+		}
+	}
+	return flush(proc.next)
+}
+
+func (proc *psUnpackProcessor) nextProcess(frame *Frame) error {
 	next := proc.next
 	if next != nil {
-		return next.Process(pkt)
+		return next.Process(frame)
 	}
 	return nil
 }
@@ -140,6 +203,7 @@ func (proc *psUnpackProcessor) h264(buf []byte) (h264bytes []byte, err error) {
 	next := buf[offset:]
 	h264 := proc.h264Buf
 	h264.Reset()
+	proc.hasPTS = false
 
 	for len(next) >= psStartCodeLen {
 		if proc.firstMainFrame && next[0] == 0x00 && next[1] == 0x00 && next[2] == 0x01 && next[3] == 0xE0 {
@@ -150,6 +214,14 @@ func (proc *psUnpackProcessor) h264(buf []byte) (h264bytes []byte, err error) {
 			}
 			pse := next[:pseLen]
 			stuffingLen := int(pse[8])
+			if !proc.hasPTS && pse[7]&0x80 != 0 && stuffingLen >= 5 && len(next) >= pseLen+5 {
+				proc.hasPTS = true
+				proc.pts = pesTimestamp(next[pseLen:])
+				proc.dts = proc.pts
+				if pse[7]&0x40 != 0 && stuffingLen >= 10 && len(next) >= pseLen+10 {
+					proc.dts = pesTimestamp(next[pseLen+5:])
+				}
+			}
 			l := uint(pse[4])<<8 + uint(pse[5])
 			size := int(l) - 2 - 1 - stuffingLen
 			offset := pseLen + stuffingLen
@@ -204,3 +276,8 @@ func (proc *psUnpackProcessor) h264(buf []byte) (h264bytes []byte, err error) {
 	}
 	return h264.Bytes(), err
 }
+
+// pesTimestamp decodes a 33 bit PTS or DTS of a PES header.
+func pesTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
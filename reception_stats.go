@@ -0,0 +1,269 @@
+package rtp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	maxDropout    = 3000
+	maxMisorder   = 100
+	minSequential = 2
+)
+
+// Results of receptionStats.update.
+const (
+	seqValid = iota
+	// seqProbation is returned while a new source is not validated yet.
+	seqProbation
+	// seqInvalid is returned for a packet too far from the expected
+	// sequence number, it is discarded.
+	seqInvalid
+	// seqRestart is returned when the sender restarted its sequence.
+	seqRestart
+)
+
+// SessionStats is a snapshot of the reception statistics of a session.
+type SessionStats struct {
+	PacketsReceived uint64
+	BytesReceived   uint64
+	// PacketsLost is the number of expected packets that were not
+	// received. It may be negative when duplicates are received.
+	PacketsLost        int64
+	PacketsReordered   uint64
+	PacketsDuplicated  uint64
+	PacketsLateDropped uint64
+	// PacketsDropped counts packets discarded because the session could
+	// not keep up with the receive rate.
+	PacketsDropped uint64
+	Jitter         time.Duration
+	// Bitrate is the payload rate in bits per second over the last second.
+	Bitrate         uint64
+	FirstPacketTime time.Time
+	LastPacketTime  time.Time
+}
+
+// receptionStats tracks per source reception state as described in
+// RFC 3550 appendix A.3 and A.8.
+type receptionStats struct {
+	mux sync.Mutex
+
+	clockRate uint32
+	// started is set once the source is validated.
+	started   bool
+	probation int
+	// first is the arrival of the first packet of the probation.
+	first time.Time
+	start time.Time
+
+	baseSeq  uint32
+	maxSeq   uint16
+	badSeq   uint32
+	cycles   uint32
+	received uint32
+
+	expectedPrior uint32
+	receivedPrior uint32
+
+	transit int64
+	jitter  float64
+
+	bytes      uint64
+	reordered  uint64
+	duplicated uint64
+	late       uint64
+	dropped    uint64
+	last       time.Time
+
+	bitrate      uint64
+	bitrateTime  time.Time
+	bitrateBytes uint64
+}
+
+const bitrateInterval = time.Second
+
+func newReceptionStats(clockRate uint32) *receptionStats {
+	return &receptionStats{clockRate: clockRate}
+}
+
+// update validates pkt as described in RFC 3550 appendix A.1 and returns
+// its extended sequence number. Packets are only accounted once the source
+// is validated by minSequential packets in sequence.
+func (stats *receptionStats) update(pkt *Packet, arrival time.Time) (result int, extended uint32) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+
+	seq := pkt.SequenceNumber
+	if !stats.started {
+		if stats.probation == 0 || seq != stats.maxSeq+1 {
+			stats.probation = minSequential
+			stats.bytes = 0
+			stats.first = arrival
+		}
+		stats.maxSeq = seq
+		stats.probation--
+		if stats.probation > 0 {
+			stats.bytes += uint64(len(pkt.Payload))
+			return seqProbation, 0
+		}
+
+		// count the packets held during the probation
+		stats.initSeq(seq - (minSequential - 1))
+		if seq < stats.maxSeq {
+			stats.cycles += 1 << 16
+		}
+		stats.maxSeq = seq
+		stats.received = minSequential - 1
+		stats.started = true
+		stats.start = arrival
+		stats.transit = stats.rtpUnits(arrival) - int64(pkt.Timestamp)
+		// the rate is measured from pkt, whose bytes are counted below
+		stats.bitrateTime = arrival
+		stats.bitrateBytes = stats.bytes + uint64(len(pkt.Payload))
+		result = seqValid
+	} else {
+		delta := seq - stats.maxSeq
+		switch {
+		case delta < maxDropout:
+			if seq < stats.maxSeq {
+				stats.cycles += 1 << 16
+			}
+			stats.maxSeq = seq
+		case int(delta) <= 1<<16-maxMisorder:
+			if uint32(seq) != stats.badSeq {
+				stats.badSeq = uint32(seq + 1)
+				return seqInvalid, 0
+			}
+			// Two sequential packets, assume the sender restarted
+			// without telling us.
+			stats.initSeq(seq)
+			stats.transit = stats.rtpUnits(arrival) - int64(pkt.Timestamp)
+			result = seqRestart
+		default:
+			stats.reordered++
+		}
+	}
+	extended = uint32(int64(stats.cycles) + int64(stats.maxSeq) + int64(int16(seq-stats.maxSeq)))
+
+	stats.received++
+	stats.bytes += uint64(len(pkt.Payload))
+	stats.last = arrival
+
+	if elapsed := arrival.Sub(stats.bitrateTime); elapsed >= bitrateInterval {
+		stats.bitrate = (stats.bytes - stats.bitrateBytes) * 8 * uint64(time.Second) / uint64(elapsed)
+		// the rate is measured from pkt, whose bytes are counted below
+		stats.bitrateTime = arrival
+		stats.bitrateBytes = stats.bytes + uint64(len(pkt.Payload))
+	}
+
+	transit := stats.rtpUnits(arrival) - int64(pkt.Timestamp)
+	d := transit - stats.transit
+	stats.transit = transit
+	if d < 0 {
+		d = -d
+	}
+	stats.jitter += (float64(d) - stats.jitter) / 16
+	return result, extended
+}
+
+func (stats *receptionStats) initSeq(seq uint16) {
+	stats.baseSeq = uint32(seq)
+	stats.maxSeq = seq
+	stats.badSeq = 1<<16 + 1
+	stats.cycles = 0
+	stats.received = 0
+	stats.expectedPrior = 0
+	stats.receivedPrior = 0
+}
+
+// rtpUnits converts arrival to the clock rate of the stream.
+func (stats *receptionStats) rtpUnits(arrival time.Time) int64 {
+	d := arrival.Sub(stats.start)
+	return int64(d/time.Second)*int64(stats.clockRate) + int64(d%time.Second)*int64(stats.clockRate)/int64(time.Second)
+}
+
+// report fills a reception report block and starts a new report interval.
+func (stats *receptionStats) report(ssrc uint32) (report ReceptionReport, ok bool) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+
+	if !stats.started {
+		return report, false
+	}
+
+	extendedMax := stats.cycles + uint32(stats.maxSeq)
+	expected := extendedMax - stats.baseSeq + 1
+	lost := int64(expected) - int64(stats.received)
+	switch {
+	case lost > 0x7FFFFF:
+		lost = 0x7FFFFF
+	case lost < -0x800000:
+		lost = -0x800000
+	}
+
+	expectedInterval := expected - stats.expectedPrior
+	stats.expectedPrior = expected
+	receivedInterval := stats.received - stats.receivedPrior
+	stats.receivedPrior = stats.received
+	lostInterval := int64(expectedInterval) - int64(receivedInterval)
+	var fraction uint8
+	if expectedInterval != 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	return ReceptionReport{
+		SSRC:               ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost) & 0xFFFFFF,
+		LastSequenceNumber: extendedMax,
+		Jitter:             uint32(stats.jitter),
+	}, true
+}
+
+func (stats *receptionStats) duplicate() {
+	stats.mux.Lock()
+	stats.duplicated++
+	stats.mux.Unlock()
+}
+
+func (stats *receptionStats) lateDrop() {
+	stats.mux.Lock()
+	stats.late++
+	stats.mux.Unlock()
+}
+
+func (stats *receptionStats) drop() {
+	stats.mux.Lock()
+	stats.dropped++
+	stats.mux.Unlock()
+}
+
+// jitterDuration returns the interarrival jitter as a duration.
+func (stats *receptionStats) jitterDuration() time.Duration {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+	return time.Duration(stats.jitter * float64(time.Second) / float64(stats.clockRate))
+}
+
+func (stats *receptionStats) snapshot() (snapshot SessionStats) {
+	stats.mux.Lock()
+	defer stats.mux.Unlock()
+
+	snapshot = SessionStats{
+		PacketsReceived:    uint64(stats.received),
+		BytesReceived:      stats.bytes,
+		PacketsReordered:   stats.reordered,
+		PacketsDuplicated:  stats.duplicated,
+		PacketsLateDropped: stats.late,
+		PacketsDropped:     stats.dropped,
+		Bitrate:            stats.bitrate,
+		LastPacketTime:     stats.last,
+	}
+	if stats.started {
+		expected := stats.cycles + uint32(stats.maxSeq) - stats.baseSeq + 1
+		snapshot.PacketsLost = int64(expected) - int64(stats.received)
+		snapshot.Jitter = time.Duration(stats.jitter * float64(time.Second) / float64(stats.clockRate))
+		snapshot.FirstPacketTime = stats.first
+	}
+	return snapshot
+}
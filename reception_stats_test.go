@@ -0,0 +1,151 @@
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReceptionStatsUpdate(t *testing.T) {
+	type step struct {
+		seq      uint16
+		result   int
+		extended uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"probation", []step{
+			{100, seqProbation, 0},
+			{101, seqValid, 101},
+			{102, seqValid, 102},
+		}},
+		{"probation restarted", []step{
+			{100, seqProbation, 0},
+			{105, seqProbation, 0},
+			{106, seqValid, 106},
+		}},
+		{"probation across wrap", []step{
+			{65535, seqProbation, 0},
+			{0, seqValid, 65536},
+			{1, seqValid, 65537},
+		}},
+		{"wrap", []step{
+			{65533, seqProbation, 0},
+			{65534, seqValid, 65534},
+			{65535, seqValid, 65535},
+			{0, seqValid, 65536},
+			{1, seqValid, 65537},
+		}},
+		{"misorder across wrap", []step{
+			{65534, seqProbation, 0},
+			{65535, seqValid, 65535},
+			{1, seqValid, 65537},
+			{0, seqValid, 65536},
+		}},
+		{"max dropout", []step{
+			{1000, seqProbation, 0},
+			{1001, seqValid, 1001},
+			{1001 + maxDropout - 1, seqValid, 1001 + maxDropout - 1},
+			{1001 + 2*maxDropout - 1, seqInvalid, 0},
+		}},
+		{"max misorder", []step{
+			{1000, seqProbation, 0},
+			{1001, seqValid, 1001},
+			{1001 - maxMisorder + 1, seqValid, 1001 - maxMisorder + 1},
+			{1001 - maxMisorder, seqInvalid, 0},
+		}},
+		{"single jump", []step{
+			{1000, seqProbation, 0},
+			{1001, seqValid, 1001},
+			{20000, seqInvalid, 0},
+			{1002, seqValid, 1002},
+		}},
+		{"restart", []step{
+			{1000, seqProbation, 0},
+			{1001, seqValid, 1001},
+			{20000, seqInvalid, 0},
+			{20001, seqRestart, 20001},
+			{20002, seqValid, 20002},
+		}},
+		{"restart before wrap", []step{
+			{1000, seqProbation, 0},
+			{1001, seqValid, 1001},
+			{65535, seqInvalid, 0},
+			{0, seqRestart, 0},
+			{1, seqValid, 1},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := newReceptionStats(defaultClockRate)
+			arrival := time.Now()
+			for i, step := range test.steps {
+				pkt := &Packet{SequenceNumber: step.seq}
+				result, extended := stats.update(pkt, arrival)
+				if result != step.result || extended != step.extended {
+					t.Fatalf("step %d seq %d: got result %d extended %d, want %d %d", i, step.seq, result, extended, step.result, step.extended)
+				}
+			}
+		})
+	}
+}
+
+func TestReceptionStatsLostAcrossWrap(t *testing.T) {
+	stats := newReceptionStats(defaultClockRate)
+	arrival := time.Now()
+	for _, seq := range []uint16{65533, 65534, 65535, 2, 3} {
+		stats.update(&Packet{SequenceNumber: seq}, arrival)
+	}
+
+	snapshot := stats.snapshot()
+	if snapshot.PacketsReceived != 5 || snapshot.PacketsLost != 2 {
+		t.Fatalf("got received %d lost %d, want 5 2", snapshot.PacketsReceived, snapshot.PacketsLost)
+	}
+	report, _ := stats.report(1)
+	if report.LastSequenceNumber != 1<<16+3 {
+		t.Fatalf("got highest extended sequence %d, want %d", report.LastSequenceNumber, 1<<16+3)
+	}
+}
+
+func TestSessionExtendedSequenceAcrossWrap(t *testing.T) {
+	srv := &Server{}
+	sess := newSession(1, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}, srv)
+	builder := NewPacketBuilder(1, 96, 65533)
+	for i := 0; i < 5; i++ {
+		sess.receive <- builder.Build(nil, uint32(i)*3000, false)
+	}
+
+	for _, want := range []uint32{65533, 65534, 65535, 65536, 65537} {
+		pkt := sess.pull()
+		if pkt == nil {
+			t.Fatalf("no packet delivered, want extended %d", want)
+		}
+		if pkt.ExtendedSequenceNumber() != want || uint16(want) != pkt.SequenceNumber {
+			t.Fatalf("got seq %d extended %d, want extended %d", pkt.SequenceNumber, pkt.ExtendedSequenceNumber(), want)
+		}
+	}
+}
+
+func TestReceptionStatsProbationTimes(t *testing.T) {
+	stats := newReceptionStats(defaultClockRate)
+	first := time.Now()
+	payload := make([]byte, 1000)
+	for i, seq := range []uint16{100, 101, 102} {
+		stats.update(&Packet{SequenceNumber: seq, Payload: payload}, first.Add(time.Duration(i)*time.Second))
+	}
+
+	snapshot := stats.snapshot()
+	if !snapshot.FirstPacketTime.Equal(first) {
+		t.Fatalf("got first packet time %v, want %v", snapshot.FirstPacketTime, first)
+	}
+	if snapshot.BytesReceived != 3000 {
+		t.Fatalf("got %d bytes received, want 3000", snapshot.BytesReceived)
+	}
+	// the bitrate is measured from the packet validating the source
+	if snapshot.Bitrate != 8000 {
+		t.Fatalf("got bitrate %d, want 8000", snapshot.Bitrate)
+	}
+}
@@ -0,0 +1,58 @@
+package rtp
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	controlErr := conn.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+var reusePortControl = reusePort
+
+// msgTrunc is set in the flags of a datagram truncated to the read buffer.
+const msgTrunc = unix.MSG_TRUNC
+
+// shardBySSRC attaches to the SO_REUSEPORT group of conn a filter steering
+// every datagram to the socket SSRC % readers, in the order the sockets
+// were bound. A datagram too short to hold an SSRC goes to the first one.
+func shardBySSRC(conn *net.UDPConn, readers int) error {
+	insts, err := bpf.Assemble([]bpf.Instruction{
+		// the filter sees the UDP payload, the SSRC follows the
+		// sequence number and timestamp
+		bpf.LoadAbsolute{Off: 8, Size: 4},
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: uint32(readers)},
+		bpf.RetA{},
+	})
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(insts))
+	for i, inst := range insts {
+		filter[i] = unix.SockFilter{Code: inst.Op, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &prog)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
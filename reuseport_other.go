@@ -0,0 +1,21 @@
+//go:build !linux
+
+package rtp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// reusePortControl is nil where SO_REUSEPORT load balancing is not
+// supported.
+var reusePortControl func(network, address string, conn syscall.RawConn) error
+
+// msgTrunc is zero where truncated datagrams are not reported.
+const msgTrunc = 0
+
+func shardBySSRC(conn *net.UDPConn, readers int) error {
+	return fmt.Errorf("ssrc sharding is not supported on %s", runtime.GOOS)
+}
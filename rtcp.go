@@ -0,0 +1,489 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+var ErrRTCPInvalid = fmt.Errorf("rtcp packet is invalid")
+
+const rtcpHeaderLen = 4
+
+const (
+	RTCPTypeSenderReport      = 200
+	RTCPTypeReceiverReport    = 201
+	RTCPTypeSourceDescription = 202
+	RTCPTypeGoodbye           = 203
+	RTCPTypeApplication       = 204
+	RTCPTypeTransportFeedback = 205
+)
+
+// Feedback message types of RTCPTypeTransportFeedback, see RFC 4585.
+const (
+	RTPFBGenericNACK = 1
+)
+
+const (
+	SDESEnd   = 0
+	SDESCNAME = 1
+	SDESName  = 2
+	SDESEmail = 3
+	SDESPhone = 4
+	SDESLoc   = 5
+	SDESTool  = 6
+	SDESNote  = 7
+	SDESPriv  = 8
+)
+
+// RTCPPacket is a single packet of an RTCP compound packet.
+type RTCPPacket interface {
+	Marshal() ([]byte, error)
+}
+
+// ReceptionReport is a report block carried by sender and receiver reports.
+type ReceptionReport struct {
+	SSRC               uint32
+	FractionLost       uint8
+	TotalLost          uint32
+	LastSequenceNumber uint32
+	Jitter             uint32
+	LastSenderReport   uint32
+	Delay              uint32
+}
+
+type SenderReport struct {
+	SSRC        uint32
+	NTPTime     uint64
+	RTPTime     uint32
+	PacketCount uint32
+	OctetCount  uint32
+	Reports     []ReceptionReport
+}
+
+type ReceiverReport struct {
+	SSRC    uint32
+	Reports []ReceptionReport
+}
+
+type SDESItem struct {
+	Type uint8
+	Text string
+}
+
+type SDESChunk struct {
+	Source uint32
+	Items  []SDESItem
+}
+
+type SourceDescription struct {
+	Chunks []SDESChunk
+}
+
+type Goodbye struct {
+	Sources []uint32
+	Reason  string
+}
+
+type ApplicationDefined struct {
+	Subtype uint8
+	SSRC    uint32
+	Name    string
+	Data    []byte
+}
+
+// RawRTCPPacket holds a packet whose type is not understood.
+type RawRTCPPacket struct {
+	Type  uint8
+	Count uint8
+	Data  []byte
+}
+
+// UnmarshalRTCP parses an RTCP compound packet.
+func UnmarshalRTCP(b []byte) (packets []RTCPPacket, err error) {
+	for len(b) > 0 {
+		if len(b) < rtcpHeaderLen {
+			return nil, ErrRTCPInvalid
+		}
+		if b[0]>>6 != 2 {
+			return nil, fmt.Errorf("rtcp packet version support 2, receive %d", b[0]>>6)
+		}
+		padding := (b[0] >> 5 & 1) > 0
+		count := b[0] & 31
+		typ := b[1]
+		size := (int(binary.BigEndian.Uint16(b[2:])) + 1) * 4
+		if size > len(b) {
+			return nil, ErrRTCPInvalid
+		}
+
+		body := b[rtcpHeaderLen:size]
+		if padding {
+			if len(body) == 0 || int(body[len(body)-1]) > len(body) {
+				return nil, ErrRTCPInvalid
+			}
+			body = body[:len(body)-int(body[len(body)-1])]
+		}
+
+		var packet RTCPPacket
+		switch typ {
+		case RTCPTypeSenderReport:
+			packet, err = unmarshalSenderReport(count, body)
+		case RTCPTypeReceiverReport:
+			packet, err = unmarshalReceiverReport(count, body)
+		case RTCPTypeSourceDescription:
+			packet, err = unmarshalSourceDescription(count, body)
+		case RTCPTypeGoodbye:
+			packet, err = unmarshalGoodbye(count, body)
+		case RTCPTypeApplication:
+			packet, err = unmarshalApplicationDefined(count, body)
+		case RTCPTypeTransportFeedback:
+			if count == RTPFBGenericNACK {
+				packet, err = unmarshalGenericNACK(body)
+			} else {
+				packet = &RawRTCPPacket{Type: typ, Count: count, Data: append([]byte(nil), body...)}
+			}
+		default:
+			packet = &RawRTCPPacket{Type: typ, Count: count, Data: append([]byte(nil), body...)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+		b = b[size:]
+	}
+	return packets, nil
+}
+
+// MarshalRTCP serializes packets as an RTCP compound packet.
+func MarshalRTCP(packets []RTCPPacket) ([]byte, error) {
+	var b []byte
+	for _, packet := range packets {
+		data, err := packet.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, data...)
+	}
+	return b, nil
+}
+
+// isRTCP reports whether b looks like an RTCP packet multiplexed on the
+// RTP port, see RFC 5761 section 4.
+func isRTCP(b []byte) bool {
+	return len(b) >= rtcpHeaderLen && b[1] >= 192 && b[1] <= 223
+}
+
+func marshalRTCPHeader(b []byte, count uint8, typ uint8) {
+	b[0] = 2<<6 | count&31
+	b[1] = typ
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)/4-1))
+}
+
+func unmarshalReceptionReports(count uint8, b []byte) ([]ReceptionReport, error) {
+	if len(b) < int(count)*24 {
+		return nil, ErrRTCPInvalid
+	}
+	reports := make([]ReceptionReport, count)
+	for i := range reports {
+		block := b[i*24:]
+		reports[i] = ReceptionReport{
+			SSRC:               binary.BigEndian.Uint32(block[0:]),
+			FractionLost:       block[4],
+			TotalLost:          binary.BigEndian.Uint32(block[4:]) & 0xFFFFFF,
+			LastSequenceNumber: binary.BigEndian.Uint32(block[8:]),
+			Jitter:             binary.BigEndian.Uint32(block[12:]),
+			LastSenderReport:   binary.BigEndian.Uint32(block[16:]),
+			Delay:              binary.BigEndian.Uint32(block[20:]),
+		}
+	}
+	return reports, nil
+}
+
+func marshalReceptionReports(b []byte, reports []ReceptionReport) {
+	for i, report := range reports {
+		block := b[i*24:]
+		binary.BigEndian.PutUint32(block[0:], report.SSRC)
+		binary.BigEndian.PutUint32(block[4:], uint32(report.FractionLost)<<24|report.TotalLost&0xFFFFFF)
+		binary.BigEndian.PutUint32(block[8:], report.LastSequenceNumber)
+		binary.BigEndian.PutUint32(block[12:], report.Jitter)
+		binary.BigEndian.PutUint32(block[16:], report.LastSenderReport)
+		binary.BigEndian.PutUint32(block[20:], report.Delay)
+	}
+}
+
+func unmarshalSenderReport(count uint8, b []byte) (*SenderReport, error) {
+	if len(b) < 24 {
+		return nil, ErrRTCPInvalid
+	}
+	sr := &SenderReport{
+		SSRC:        binary.BigEndian.Uint32(b[0:]),
+		NTPTime:     binary.BigEndian.Uint64(b[4:]),
+		RTPTime:     binary.BigEndian.Uint32(b[12:]),
+		PacketCount: binary.BigEndian.Uint32(b[16:]),
+		OctetCount:  binary.BigEndian.Uint32(b[20:]),
+	}
+	reports, err := unmarshalReceptionReports(count, b[24:])
+	if err != nil {
+		return nil, err
+	}
+	sr.Reports = reports
+	return sr, nil
+}
+
+func (sr *SenderReport) Marshal() ([]byte, error) {
+	if len(sr.Reports) > 31 {
+		return nil, fmt.Errorf("rtcp report count %d exceeds 31", len(sr.Reports))
+	}
+	b := make([]byte, rtcpHeaderLen+24+len(sr.Reports)*24)
+	marshalRTCPHeader(b, uint8(len(sr.Reports)), RTCPTypeSenderReport)
+	binary.BigEndian.PutUint32(b[4:], sr.SSRC)
+	binary.BigEndian.PutUint64(b[8:], sr.NTPTime)
+	binary.BigEndian.PutUint32(b[16:], sr.RTPTime)
+	binary.BigEndian.PutUint32(b[20:], sr.PacketCount)
+	binary.BigEndian.PutUint32(b[24:], sr.OctetCount)
+	marshalReceptionReports(b[28:], sr.Reports)
+	return b, nil
+}
+
+func unmarshalReceiverReport(count uint8, b []byte) (*ReceiverReport, error) {
+	if len(b) < 4 {
+		return nil, ErrRTCPInvalid
+	}
+	rr := &ReceiverReport{SSRC: binary.BigEndian.Uint32(b)}
+	reports, err := unmarshalReceptionReports(count, b[4:])
+	if err != nil {
+		return nil, err
+	}
+	rr.Reports = reports
+	return rr, nil
+}
+
+func (rr *ReceiverReport) Marshal() ([]byte, error) {
+	if len(rr.Reports) > 31 {
+		return nil, fmt.Errorf("rtcp report count %d exceeds 31", len(rr.Reports))
+	}
+	b := make([]byte, rtcpHeaderLen+4+len(rr.Reports)*24)
+	marshalRTCPHeader(b, uint8(len(rr.Reports)), RTCPTypeReceiverReport)
+	binary.BigEndian.PutUint32(b[4:], rr.SSRC)
+	marshalReceptionReports(b[8:], rr.Reports)
+	return b, nil
+}
+
+func unmarshalSourceDescription(count uint8, b []byte) (*SourceDescription, error) {
+	sdes := &SourceDescription{Chunks: make([]SDESChunk, 0, count)}
+	for i := 0; i < int(count); i++ {
+		if len(b) < 4 {
+			return nil, ErrRTCPInvalid
+		}
+		chunk := SDESChunk{Source: binary.BigEndian.Uint32(b)}
+		offset := 4
+		for {
+			if offset >= len(b) {
+				return nil, ErrRTCPInvalid
+			}
+			typ := b[offset]
+			if typ == SDESEnd {
+				offset++
+				break
+			}
+			if offset+2 > len(b) || offset+2+int(b[offset+1]) > len(b) {
+				return nil, ErrRTCPInvalid
+			}
+			l := int(b[offset+1])
+			chunk.Items = append(chunk.Items, SDESItem{Type: typ, Text: string(b[offset+2 : offset+2+l])})
+			offset += 2 + l
+		}
+		// chunks are padded to a 32-bit boundary
+		offset = (offset + 3) / 4 * 4
+		if offset > len(b) {
+			offset = len(b)
+		}
+		sdes.Chunks = append(sdes.Chunks, chunk)
+		b = b[offset:]
+	}
+	return sdes, nil
+}
+
+func (sdes *SourceDescription) Marshal() ([]byte, error) {
+	if len(sdes.Chunks) > 31 {
+		return nil, fmt.Errorf("rtcp sdes chunk count %d exceeds 31", len(sdes.Chunks))
+	}
+	b := make([]byte, rtcpHeaderLen)
+	for _, chunk := range sdes.Chunks {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], chunk.Source)
+		for _, item := range chunk.Items {
+			if len(item.Text) > 255 {
+				return nil, fmt.Errorf("rtcp sdes item too long: %d", len(item.Text))
+			}
+			b = append(b, item.Type, uint8(len(item.Text)))
+			b = append(b, item.Text...)
+		}
+		b = append(b, SDESEnd)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	marshalRTCPHeader(b, uint8(len(sdes.Chunks)), RTCPTypeSourceDescription)
+	return b, nil
+}
+
+// CNAME returns the canonical name of ssrc, or an empty string.
+func (sdes *SourceDescription) CNAME(ssrc uint32) string {
+	for _, chunk := range sdes.Chunks {
+		if chunk.Source != ssrc {
+			continue
+		}
+		for _, item := range chunk.Items {
+			if item.Type == SDESCNAME {
+				return item.Text
+			}
+		}
+	}
+	return ""
+}
+
+func unmarshalGoodbye(count uint8, b []byte) (*Goodbye, error) {
+	if len(b) < int(count)*4 {
+		return nil, ErrRTCPInvalid
+	}
+	bye := &Goodbye{Sources: make([]uint32, count)}
+	for i := range bye.Sources {
+		bye.Sources[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	b = b[int(count)*4:]
+	if len(b) > 0 {
+		l := int(b[0])
+		if 1+l > len(b) {
+			return nil, ErrRTCPInvalid
+		}
+		bye.Reason = string(b[1 : 1+l])
+	}
+	return bye, nil
+}
+
+func (bye *Goodbye) Marshal() ([]byte, error) {
+	if len(bye.Sources) > 31 {
+		return nil, fmt.Errorf("rtcp bye source count %d exceeds 31", len(bye.Sources))
+	}
+	if len(bye.Reason) > 255 {
+		return nil, fmt.Errorf("rtcp bye reason too long: %d", len(bye.Reason))
+	}
+	b := make([]byte, rtcpHeaderLen+len(bye.Sources)*4)
+	for i, ssrc := range bye.Sources {
+		binary.BigEndian.PutUint32(b[rtcpHeaderLen+i*4:], ssrc)
+	}
+	if len(bye.Reason) > 0 {
+		b = append(b, uint8(len(bye.Reason)))
+		b = append(b, bye.Reason...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	marshalRTCPHeader(b, uint8(len(bye.Sources)), RTCPTypeGoodbye)
+	return b, nil
+}
+
+func unmarshalApplicationDefined(count uint8, b []byte) (*ApplicationDefined, error) {
+	if len(b) < 8 {
+		return nil, ErrRTCPInvalid
+	}
+	return &ApplicationDefined{
+		Subtype: count,
+		SSRC:    binary.BigEndian.Uint32(b),
+		Name:    string(b[4:8]),
+		Data:    append([]byte(nil), b[8:]...),
+	}, nil
+}
+
+func (app *ApplicationDefined) Marshal() ([]byte, error) {
+	if len(app.Name) != 4 {
+		return nil, fmt.Errorf("rtcp app name must be 4 bytes: %q", app.Name)
+	}
+	if len(app.Data)%4 != 0 {
+		return nil, fmt.Errorf("rtcp app data size is not a multiple of 4")
+	}
+	b := make([]byte, rtcpHeaderLen+8+len(app.Data))
+	binary.BigEndian.PutUint32(b[4:], app.SSRC)
+	copy(b[8:], app.Name)
+	copy(b[12:], app.Data)
+	marshalRTCPHeader(b, app.Subtype, RTCPTypeApplication)
+	return b, nil
+}
+
+// GenericNACK requests retransmission of lost packets, see RFC 4585
+// section 6.2.1.
+type GenericNACK struct {
+	SenderSSRC uint32
+	MediaSSRC  uint32
+	Lost       []uint16
+}
+
+func unmarshalGenericNACK(b []byte) (*GenericNACK, error) {
+	if len(b) < 8 || len(b)%4 != 0 {
+		return nil, ErrRTCPInvalid
+	}
+	nack := &GenericNACK{
+		SenderSSRC: binary.BigEndian.Uint32(b[0:]),
+		MediaSSRC:  binary.BigEndian.Uint32(b[4:]),
+	}
+	for i := 8; i < len(b); i += 4 {
+		pid := binary.BigEndian.Uint16(b[i:])
+		blp := binary.BigEndian.Uint16(b[i+2:])
+		nack.Lost = append(nack.Lost, pid)
+		for j := uint16(0); j < 16; j++ {
+			if blp&(1<<j) != 0 {
+				nack.Lost = append(nack.Lost, pid+j+1)
+			}
+		}
+	}
+	return nack, nil
+}
+
+// Marshal encodes Lost, which must be in transmission order, as PID and
+// BLP pairs.
+func (nack *GenericNACK) Marshal() ([]byte, error) {
+	b := make([]byte, rtcpHeaderLen+8, rtcpHeaderLen+8+len(nack.Lost)*4)
+	binary.BigEndian.PutUint32(b[4:], nack.SenderSSRC)
+	binary.BigEndian.PutUint32(b[8:], nack.MediaSSRC)
+	for i := 0; i < len(nack.Lost); {
+		pid := nack.Lost[i]
+		blp := uint16(0)
+		i++
+		for ; i < len(nack.Lost); i++ {
+			diff := nack.Lost[i] - pid
+			if diff == 0 || diff > 16 {
+				break
+			}
+			blp |= 1 << (diff - 1)
+		}
+		b = append(b, uint8(pid>>8), uint8(pid), uint8(blp>>8), uint8(blp))
+	}
+	marshalRTCPHeader(b, RTPFBGenericNACK, RTCPTypeTransportFeedback)
+	return b, nil
+}
+
+func (raw *RawRTCPPacket) Marshal() ([]byte, error) {
+	if len(raw.Data)%4 != 0 {
+		return nil, fmt.Errorf("rtcp packet size is not a multiple of 4")
+	}
+	b := make([]byte, rtcpHeaderLen+len(raw.Data))
+	copy(b[rtcpHeaderLen:], raw.Data)
+	marshalRTCPHeader(b, raw.Count, raw.Type)
+	return b, nil
+}
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 and 1970-01-01.
+const ntpEpochOffset = 2208988800
+
+func ntpToTime(ntp uint64) time.Time {
+	sec := int64(ntp>>32) - ntpEpochOffset
+	nsec := int64((ntp & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(sec, nsec)
+}
+
+func timeToNTP(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return sec<<32 | frac
+}
@@ -0,0 +1,166 @@
+package rtp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRTCPRoundTrip(t *testing.T) {
+	report := ReceptionReport{
+		SSRC:               1,
+		FractionLost:       25,
+		TotalLost:          0xFFFFFF,
+		LastSequenceNumber: 1<<16 + 3,
+		Jitter:             90,
+		LastSenderReport:   0x12345678,
+		Delay:              65536,
+	}
+	packets := []RTCPPacket{
+		&SenderReport{SSRC: 1, NTPTime: 0x0102030405060708, RTPTime: 3000, PacketCount: 10, OctetCount: 12000, Reports: []ReceptionReport{report}},
+		&ReceiverReport{SSRC: 2, Reports: []ReceptionReport{report, report}},
+		&SourceDescription{Chunks: []SDESChunk{
+			{Source: 1, Items: []SDESItem{{Type: SDESCNAME, Text: "user@host"}, {Type: SDESTool, Text: "go-rtp"}}},
+			{Source: 2, Items: []SDESItem{{Type: SDESName, Text: "abc"}}},
+		}},
+		&Goodbye{Sources: []uint32{1, 2}, Reason: "done"},
+		&ApplicationDefined{Subtype: 3, SSRC: 1, Name: "TEST", Data: []byte{1, 2, 3, 4}},
+		&GenericNACK{SenderSSRC: 1, MediaSSRC: 2, Lost: []uint16{10, 12, 26, 30}},
+		&RawRTCPPacket{Type: RTCPTypeTransportFeedback, Count: 15, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+	}
+
+	b, err := MarshalRTCP(packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isRTCP(b) {
+		t.Fatal("compound packet is not detected as rtcp")
+	}
+	got, err := UnmarshalRTCP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), len(packets))
+	}
+	for i := range packets {
+		if !reflect.DeepEqual(got[i], packets[i]) {
+			t.Fatalf("packet %d: got %+v, want %+v", i, got[i], packets[i])
+		}
+	}
+	if cname := got[2].(*SourceDescription).CNAME(1); cname != "user@host" {
+		t.Fatalf("got cname %q, want user@host", cname)
+	}
+}
+
+func TestGenericNACKWraparound(t *testing.T) {
+	tests := []struct {
+		name string
+		lost []uint16
+		// pairs are the PID and BLP fields on the wire
+		pairs []uint16
+	}{
+		{"within bitmask", []uint16{65534, 65535, 0, 1}, []uint16{65534, 0x0007}},
+		{"bitmask end", []uint16{65530, 10}, []uint16{65530, 0x8000}},
+		{"past bitmask", []uint16{65530, 11}, []uint16{65530, 0, 11, 0}},
+		{"pid after wrap", []uint16{65535, 0, 17}, []uint16{65535, 0x0001, 17, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nack := &GenericNACK{SenderSSRC: 1, MediaSSRC: 2, Lost: test.lost}
+			b, err := nack.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pairs []uint16
+			for i := 12; i < len(b); i += 2 {
+				pairs = append(pairs, uint16(b[i])<<8|uint16(b[i+1]))
+			}
+			if !reflect.DeepEqual(pairs, test.pairs) {
+				t.Fatalf("got pid and blp %v, want %v", pairs, test.pairs)
+			}
+
+			packets, err := UnmarshalRTCP(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := packets[0].(*GenericNACK); !reflect.DeepEqual(got.Lost, test.lost) {
+				t.Fatalf("got lost %v, want %v", got.Lost, test.lost)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRTCPPadding(t *testing.T) {
+	// a bye without reason padded with 4 octets
+	b := []byte{0xA1, RTCPTypeGoodbye, 0, 2, 0, 0, 0, 1, 0, 0, 0, 4}
+	packets, err := UnmarshalRTCP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bye := packets[0].(*Goodbye); !reflect.DeepEqual(bye, &Goodbye{Sources: []uint32{1}}) {
+		t.Fatalf("got %+v", bye)
+	}
+}
+
+func TestUnmarshalRTCPMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"short header", []byte{0x80, RTCPTypeReceiverReport, 0}},
+		{"length beyond packet", []byte{0x80, RTCPTypeReceiverReport, 0, 2, 0, 0, 0, 1}},
+		{"padding beyond body", []byte{0xA0, RTCPTypeReceiverReport, 0, 1, 0, 0, 0, 5}},
+		{"short sender report", []byte{0x80, RTCPTypeSenderReport, 0, 1, 0, 0, 0, 1}},
+		{"missing report block", []byte{0x81, RTCPTypeReceiverReport, 0, 1, 0, 0, 0, 1}},
+		{"unterminated sdes", []byte{0x81, RTCPTypeSourceDescription, 0, 2, 0, 0, 0, 1, SDESCNAME, 2, 'a', 'b'}},
+		{"sdes item overrun", []byte{0x81, RTCPTypeSourceDescription, 0, 2, 0, 0, 0, 1, SDESCNAME, 9, 'a', 'b'}},
+		{"bye reason overrun", []byte{0x81, RTCPTypeGoodbye, 0, 2, 0, 0, 0, 1, 5, 'a', 'b', 'c'}},
+		{"short app", []byte{0x80, RTCPTypeApplication, 0, 1, 0, 0, 0, 1}},
+		{"short nack", []byte{0x81, RTCPTypeTransportFeedback, 0, 1, 0, 0, 0, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := UnmarshalRTCP(test.b); !errors.Is(err, ErrRTCPInvalid) {
+				t.Fatalf("got %v, want %v", err, ErrRTCPInvalid)
+			}
+		})
+	}
+
+	if _, err := UnmarshalRTCP([]byte{0x40, RTCPTypeReceiverReport, 0, 0}); err == nil {
+		t.Fatal("rtcp version 1 accepted")
+	}
+}
+
+func TestRTCPMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet RTCPPacket
+	}{
+		{"report count", &ReceiverReport{Reports: make([]ReceptionReport, 32)}},
+		{"sdes item size", &SourceDescription{Chunks: []SDESChunk{{Items: []SDESItem{{Type: SDESNote, Text: string(bytes.Repeat([]byte{'a'}, 256))}}}}}},
+		{"bye reason size", &Goodbye{Reason: string(bytes.Repeat([]byte{'a'}, 256))}},
+		{"app name", &ApplicationDefined{Name: "abc"}},
+		{"app data size", &ApplicationDefined{Name: "TEST", Data: []byte{1}}},
+		{"raw data size", &RawRTCPPacket{Type: 210, Data: []byte{1}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.packet.Marshal(); err == nil {
+				t.Fatal("marshal succeeded")
+			}
+		})
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	if got := ntpToTime(timeToNTP(now)); got.Sub(now).Abs() > time.Microsecond {
+		t.Fatalf("got %v, want %v", got, now)
+	}
+}
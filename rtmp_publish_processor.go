@@ -2,26 +2,40 @@ package rtp
 
 import (
 	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 
 	rtmp "github.com/zhangpeihao/gortmp"
 )
 
+// rtmpPublishFailures counts failed rtmp connects and publishes of every
+// server of the process.
+var rtmpPublishFailures uint64
+
 type rtmpPublishProcessor struct {
-	next Processor
-	mux  sync.Mutex
+	mux sync.Mutex
 
 	handler *rtmpSinkHandler
 	obConn  rtmp.OutboundConn
 	stream  rtmp.OutboundStream
 	url     string
 	name    string
+	logger  *slog.Logger
 }
 
-func NewRTMPPublishProcessor(url, name string) (p Processor, err error) {
-	proc := &rtmpPublishProcessor{url: url, name: name}
+// NewRTMPPublishProcessor publishes FLV tags to the stream name of the rtmp
+// server at url.
+func NewRTMPPublishProcessor(url, name string) (p Stage[*FlvTag], err error) {
+	defer func() {
+		if err != nil {
+			atomic.AddUint64(&rtmpPublishFailures, 1)
+		}
+	}()
+
+	proc := &rtmpPublishProcessor{url: url, name: name, logger: logger}
 
-	handler := newrtmpSinkHandler()
+	handler := newrtmpSinkHandler(proc)
 	handler.createStreamChan = make(chan rtmp.OutboundStream)
 	handler.startPublishChan = make(chan rtmp.OutboundStream)
 	proc.handler = handler
@@ -47,43 +61,30 @@ func NewRTMPPublishProcessor(url, name string) (p Processor, err error) {
 	return proc, nil
 }
 
-func (proc *rtmpPublishProcessor) Process(packet interface{}) error {
-	flvTag, ok := packet.(*FlvTag)
-	if !ok {
-		return fmt.Errorf("rtmpPublishProcessor process pkt is not *FlvTag")
-	}
+func (proc *rtmpPublishProcessor) Process(flvTag *FlvTag) error {
 	select {
 	case <-proc.handler.closed:
-		logger.Printf("rtmp closed, rtmp %v, name %v\n", proc.url, proc.name)
+		atomic.AddUint64(&rtmpPublishFailures, 1)
+		proc.logger.Warn("rtmp closed", "url", proc.url, "name", proc.name)
 		return fmt.Errorf("rtmp closed")
 	default:
 	}
 
-	return proc.stream.PublishData(flvTag.TagType, flvTag.Data, flvTag.Timestamp)
-}
-
-func (proc *rtmpPublishProcessor) Attach(next Processor) {
-	old := proc.next
-	proc.next = next
-	if old != nil {
-		old.Release()
+	err := proc.stream.PublishData(flvTag.TagType, flvTag.Data, flvTag.Timestamp)
+	if err != nil {
+		atomic.AddUint64(&rtmpPublishFailures, 1)
 	}
+	return err
 }
 
-func (proc *rtmpPublishProcessor) Release() {
-	next := proc.next
-	if next != nil {
-		next.Release()
-	}
+func (proc *rtmpPublishProcessor) SetLogger(logger *slog.Logger) {
+	proc.logger = logger
 }
 
-func (proc *rtmpPublishProcessor) nextProcess(pkt interface{}) {
+// Release closes the rtmp stream and connection.
+func (proc *rtmpPublishProcessor) Release() {
 	proc.stream.Close()
 	proc.obConn.Close()
-	next := proc.next
-	if next != nil {
-		next.Process(pkt)
-	}
 }
 
 type rtmpSinkHandler struct {
@@ -95,11 +96,13 @@ type rtmpSinkHandler struct {
 	audioDataSize    int64
 	startPublish     bool
 	closed           chan bool
+	proc             *rtmpPublishProcessor
 }
 
-func newrtmpSinkHandler() *rtmpSinkHandler {
+func newrtmpSinkHandler(proc *rtmpPublishProcessor) *rtmpSinkHandler {
 	return &rtmpSinkHandler{
 		closed: make(chan bool),
+		proc:   proc,
 	}
 }
 
@@ -107,7 +110,7 @@ func (handler *rtmpSinkHandler) OnStatus(conn rtmp.OutboundConn) {
 	var err error
 	handler.status, err = conn.Status()
 	if err != nil {
-		logger.Printf("rtmp status: %d, err: %v\n", handler.status, err)
+		handler.proc.logger.Warn("rtmp status failed", "url", handler.proc.url, "status", handler.status, "err", err)
 	}
 }
 
@@ -1,8 +1,10 @@
 package rtp
 
 import (
-	"log"
+	"log/slog"
 	"os"
 )
 
-var logger = log.New(os.Stdout, "[rtp] ", log.LstdFlags)
+// logger is used by servers without a Logger and by processors that are
+// not attached to a session.
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil)).With("module", "rtp")
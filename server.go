@@ -1,10 +1,13 @@
 package rtp
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"math/rand"
 	"net"
-	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,34 +17,159 @@ var ErrServerClosed = fmt.Errorf("server be closed")
 type Server struct {
 	Addr          string
 	ActiveTimeout time.Duration
+	// Readers is the number of goroutines reading UDP, each on its own
+	// SO_REUSEPORT socket where supported. Datagrams are sharded by SSRC,
+	// so the packets of a stream are read by one reader and keep their
+	// order even when its address changes. It defaults to 1.
+	Readers int
+	// ReadBatch is the number of datagrams read by a single system call,
+	// it defaults to 16.
+	ReadBatch int
+	// Network is "udp" or "tcp", it defaults to "udp". Over tcp, RTP and
+	// RTCP are framed as described in RFC 4571.
+	Network string
+
+	// RTCPAddr is the address receiving RTCP, conventionally the port
+	// following Addr. RTCP is ignored when it is empty and RTCPMux is false.
+	// RTCP is only accepted from the IP sending the RTP of its session.
+	RTCPAddr string
+	// RTCPMux demultiplexes RTCP arriving on Addr, see RFC 5761.
+	RTCPMux bool
+	// ReportInterval is the period of RTCP receiver reports sent to every
+	// session. Receiver reports are disabled when it is zero.
+	ReportInterval time.Duration
+	// NACKTimeout enables RFC 4585 generic NACK. A session requests the
+	// retransmission of every sequence gap and waits up to NACKTimeout for
+	// it before skipping the gap. NACK is disabled when it is zero.
+	NACKTimeout time.Duration
+	// JitterTarget is the minimum time a session waits for a missing
+	// packet before skipping it, it defaults to 40ms. The wait grows with
+	// the measured interarrival jitter up to JitterMax, which defaults to
+	// 400ms and also bounds the wait for NACK retransmissions.
+	JitterTarget time.Duration
+	JitterMax    time.Duration
+	// Demux selects how packets are demultiplexed into sessions, it
+	// defaults to DemuxBySSRC.
+	Demux DemuxMode
+	// OnAddrChange is called when a known SSRC is received from a new
+	// address, e.g. after a NAT rebinding or on an SSRC collision. When it
+	// returns true the session follows the new address. Otherwise the
+	// packets are dropped with DemuxBySSRC, or create their own session
+	// with the other modes. When it is nil the packets are treated as a
+	// collision as described in RFC 3550 section 8.2.
+	OnAddrChange func(sess *Session, raddr net.Addr) bool
+	// Admission, when set, decides whether a packet of an unknown source
+	// creates a session. Rejected packets are counted and dropped.
+	Admission Admitter
+	// Handler, when set, is called for every new session instead of
+	// delivering it to Accept. It runs on the session goroutine before the
+	// first packet is processed, so processors attached by Handler see
+	// every packet.
+	Handler func(sess *Session)
+	// OnFirstPacket, when set, is called on the session goroutine when the
+	// session receives its first packet.
+	OnFirstPacket func(sess *Session)
+	// OnFirstKeyframe, when set, is called when a processor of the session
+	// unpacks its first keyframe.
+	OnFirstKeyframe func(sess *Session)
+	// StallTimeout is the time without packets after which OnStall is
+	// called, then OnResume when packets arrive again. It is shorter than
+	// ActiveTimeout, which closes the session.
+	StallTimeout time.Duration
+	OnStall      func(sess *Session)
+	OnResume     func(sess *Session)
+	// OnClose, when set, is called once the session goroutine exits with
+	// the reason the session was closed.
+	OnClose func(sess *Session, reason error)
+	// Logger receives the logs of the server and its sessions, a text
+	// logger writing to stdout is used when it is nil.
+	Logger *slog.Logger
+	// ClockRate is the RTP timestamp rate of the received streams, it
+	// defaults to 90000.
+	ClockRate uint32
 
 	sessions *sync.Map
+	expected *sync.Map
 	accept   chan *Session
 	wg       sync.WaitGroup
 
-	mux      sync.Mutex
-	listener *net.UDPConn
-	closed   chan bool
-	state    int8
+	mux         sync.Mutex
+	listener    *net.UDPConn
+	listeners   []*net.UDPConn
+	tcpListener net.Listener
+	conns       *sync.Map
+	rtcpConn    *net.UDPConn
+	closed      chan bool
+	// drain is closed by Shutdown
+	drain chan bool
+	state int8
 
 	pktPool *sync.Pool
+	ssrc    uint32
+
+	sessionCount int64
+	sourceCounts map[string]int
+	sourceMux    sync.Mutex
+
+	malformedPackets  uint64
+	rejectedPackets   uint64
+	ssrcCollisions    uint64
+	versionMismatches uint64
+	droppedPackets    uint64
+	acceptedSessions  uint64
+	rejectedSessions  uint64
+	processorErrors   uint64
 }
 
+const defaultClockRate = 90000
+
 const (
 	serverStatusReady    = 0
 	serverStatusRunning  = 1
 	serverStatusStopping = 2
+	serverStatusDraining = 3
 )
 
+var shutdownPollInterval = 50 * time.Millisecond
+
 func (srv *Server) Serve() (err error) {
-	laddr, err := net.ResolveUDPAddr("udp", srv.Addr)
-	if err != nil {
-		return err
+	var listeners []*net.UDPConn
+	var tcpListener net.Listener
+	switch srv.Network {
+	case "", "udp":
+		listeners, err = srv.listenUDP()
+		if err != nil {
+			return err
+		}
+	case "tcp":
+		tcpListener, err = net.Listen("tcp", srv.Addr)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("server network %q is not supported", srv.Network)
+	}
+	closeListener := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		if tcpListener != nil {
+			tcpListener.Close()
+		}
 	}
 
-	listener, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		return err
+	var rtcpConn *net.UDPConn
+	if srv.RTCPAddr != "" {
+		rtcpLaddr, err := net.ResolveUDPAddr("udp", srv.RTCPAddr)
+		if err != nil {
+			closeListener()
+			return err
+		}
+		rtcpConn, err = net.ListenUDP("udp", rtcpLaddr)
+		if err != nil {
+			closeListener()
+			return err
+		}
 	}
 
 	if srv.pktPool == nil {
@@ -54,30 +182,80 @@ func (srv *Server) Serve() (err error) {
 	srv.mux.Lock()
 	if srv.state != serverStatusReady {
 		srv.mux.Unlock()
+		closeListener()
+		if rtcpConn != nil {
+			rtcpConn.Close()
+		}
 		return fmt.Errorf("server is running")
 	} else {
 		srv.state = serverStatusRunning
 		srv.mux.Unlock()
 	}
 
+	srv.ssrc = rand.Uint32()
 	srv.closed = make(chan bool)
+	srv.drain = make(chan bool)
 	srv.accept = make(chan *Session)
-	srv.listener = listener
+	srv.listeners = listeners
+	if len(listeners) > 0 {
+		srv.listener = listeners[0]
+	}
+	srv.tcpListener = tcpListener
+	srv.conns = &sync.Map{}
+	srv.rtcpConn = rtcpConn
 	srv.sessions = &sync.Map{}
-	async(&srv.wg, srv.loopHandleRead)
+	srv.expected = &sync.Map{}
+	for _, listener := range listeners {
+		listener := listener
+		async(&srv.wg, func() {
+			srv.loopHandleRead(listener)
+		})
+	}
+	if tcpListener != nil {
+		async(&srv.wg, srv.loopHandleAccept)
+	}
+	if rtcpConn != nil {
+		async(&srv.wg, srv.loopHandleRTCP)
+	}
+	if srv.ReportInterval > 0 {
+		async(&srv.wg, srv.loopSendReports)
+	}
 	async(&srv.wg, srv.loopHandleUnactive)
 
 	return nil
 }
 
+// ServeContext starts the server like Serve and blocks until it is closed
+// by Close or Shutdown, returning ErrServerClosed. When ctx is done first
+// the server is closed and ctx.Err() is returned.
+func (srv *Server) ServeContext(ctx context.Context) error {
+	if err := srv.Serve(); err != nil {
+		return err
+	}
+
+	select {
+	case <-srv.closed:
+		return ErrServerClosed
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
 func (srv *Server) loopHandleUnactive() {
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	for {
 		srv.sessions.Range(func(key interface{}, val interface{}) bool {
 			sess := val.(*Session)
-			if srv.ActiveTimeout > 0 && int64(srv.ActiveTimeout) < time.Now().UnixNano()-sess.lastActiveTime {
-				sess.close()
+			idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&sess.lastActiveTime))
+			if srv.ActiveTimeout > 0 && idle > srv.ActiveTimeout {
+				sess.close(ErrSessionTimeout)
+			} else if srv.StallTimeout > 0 && idle > srv.StallTimeout && atomic.CompareAndSwapInt32(&sess.stalled, 0, 1) {
+				sess.log().Info("session stalled", "idle", idle)
+				if srv.OnStall != nil {
+					srv.OnStall(sess)
+				}
 			}
 			return true
 		})
@@ -90,79 +268,306 @@ func (srv *Server) loopHandleUnactive() {
 	}
 }
 
-func (srv *Server) loopHandleRead() {
+// handlePacket dispatches a received datagram or RFC 4571 frame to its
+// session, creating the session on its first packet. conn is nil for
+// packets received on the UDP listener.
+func (srv *Server) handlePacket(b []byte, raddr net.Addr, conn *tcpConn) *Session {
+	if (srv.RTCPMux || conn != nil) && isRTCP(b) {
+		srv.handleRTCP(b, raddr)
+		return nil
+	}
+
+	pkt := srv.parsePacket(b, raddr)
+	if pkt == nil {
+		return nil
+	}
+	return srv.dispatch(pkt, raddr, conn)
+}
+
+// dispatch delivers a parsed packet to its session.
+func (srv *Server) dispatch(pkt *Packet, raddr net.Addr, conn *tcpConn) *Session {
+	sess, drop := srv.lookupSession(pkt.SSRC, raddr)
+	if !drop && sess == nil {
+		sess = srv.createSession(pkt.SSRC, raddr, conn)
+	}
+	if sess == nil {
+		pkt.release()
+		return nil
+	}
+
+	srv.deliver(sess, pkt)
+	return sess
+}
+
+// createSession starts the session of the first packet of ssrc from
+// raddr, it returns nil if the session is rejected.
+func (srv *Server) createSession(ssrc uint32, raddr net.Addr, conn *tcpConn) (sess *Session) {
+	if srv.draining() {
+		return nil
+	}
+
+	if sess = srv.activateExpected(ssrc, raddr, conn); sess != nil {
+		srv.startSession(sess, nil)
+		return sess
+	}
+
+	if srv.Admission != nil && !srv.Admission.Admit(srv, ssrc, raddr) {
+		atomic.AddUint64(&srv.rejectedPackets, 1)
+		return nil
+	}
+
+	var limits sessionLimits
+	if limiter, ok := srv.Admission.(sessionLimiter); ok {
+		limits = limiter.sessionLimits()
+	}
+	sess = newSession(ssrc, raddr, srv)
+	sess.conn = conn
+	switch srv.addSessionLimited(sess, limits) {
+	case addSessionExists:
+		// created concurrently by another reader
+		sess, _ = srv.lookupSession(ssrc, raddr)
+		return sess
+	case addSessionLimited:
+		atomic.AddUint64(&srv.rejectedPackets, 1)
+		return nil
+	}
+	if srv.Handler != nil {
+		atomic.AddUint64(&srv.acceptedSessions, 1)
+		srv.startSession(sess, srv.Handler)
+		return sess
+	}
+
+	select {
+	case srv.accept <- sess:
+		atomic.AddUint64(&srv.acceptedSessions, 1)
+		srv.startSession(sess, nil)
+		return sess
+	default:
+		srv.removeSession(sess)
+		atomic.AddUint64(&srv.rejectedSessions, 1)
+		srv.logger().Warn("session can't be accepted, will be drop", "remote_addr", raddr.String(), "ssrc", ssrc)
+		return nil
+	}
+}
+
+// parsePacket unmarshals a received RTP packet, it returns nil if the
+// packet is dropped.
+func (srv *Server) parsePacket(b []byte, raddr net.Addr) *Packet {
+	pkt := srv.pktPool.Get().(*Packet)
+	pkt.arrival = time.Now()
+	if !srv.validPacket(pkt, pkt.unmarshal(b), raddr) {
+		return nil
+	}
+	return pkt
+}
+
+// validPacket counts and releases a packet that failed to parse or has an
+// unsupported version.
+func (srv *Server) validPacket(pkt *Packet, err error, raddr net.Addr) bool {
+	if err != nil {
+		atomic.AddUint64(&srv.malformedPackets, 1)
+		srv.logger().Debug("rtp packet unmarshal failed", "remote_addr", raddr.String(), "err", err)
+		pkt.release()
+		return false
+	}
+
+	if pkt.Version != 2 {
+		atomic.AddUint64(&srv.versionMismatches, 1)
+		srv.logger().Debug("rtp packet version unsupported", "remote_addr", raddr.String(), "ssrc", pkt.SSRC, "version", pkt.Version)
+		pkt.release()
+		return false
+	}
+	return true
+}
+
+// startSession processes sess until it is closed, then releases its
+// processor. handler, if not nil, is called before the first packet is
+// processed.
+func (srv *Server) startSession(sess *Session, handler func(sess *Session)) {
+	async(&srv.wg, func() {
+		if handler != nil {
+			handler(sess)
+		}
+		reason := ErrServerClosed
+		if err := sess.process(); err != nil {
+			sess.log().Error("process session failed", "err", err)
+			reason = fmt.Errorf("session process failed: %w", err)
+		}
+		// a no-op unless the processor failed or the session drained
+		sess.close(reason)
+		srv.removeSession(sess)
+		sess.release()
+		if srv.OnClose != nil {
+			srv.OnClose(sess, sess.Err())
+		}
+	})
+}
+
+func (srv *Server) deliver(sess *Session, pkt *Packet) {
+	atomic.StoreInt64(&sess.lastActiveTime, pkt.arrival.UnixNano())
+
+	select {
+	case sess.receive <- pkt:
+	default:
+		sess.stats.drop()
+		atomic.AddUint64(&srv.droppedPackets, 1)
+		sess.log().Debug("pkt can't be receive, will be drop", "seq", pkt.SequenceNumber)
+		pkt.release()
+	}
+}
+
+func (srv *Server) closeSessions() {
+	srv.sessions.Range(func(key interface{}, val interface{}) bool {
+		sess := val.(*Session)
+		sess.close(ErrServerClosed)
+		srv.removeSession(sess)
+		return true
+	})
+}
+
+func (srv *Server) loopHandleRTCP() {
 	for {
 		buf := make([]byte, maxUDPPacketSize)
-		n, raddr, err := srv.listener.ReadFrom(buf)
+		n, raddr, err := srv.rtcpConn.ReadFrom(buf)
 		if err != nil {
 			break
 		}
+		srv.handleRTCP(buf[:n], raddr)
+	}
+}
 
-		pkt := srv.pktPool.Get().(*Packet)
-		err = pkt.unmarshal(buf[:n])
-		if err != nil {
-			logger.Println("rtp packet unmarshal err:", err)
-			pkt.release()
-			continue
-		}
-
-		if pkt.Version != 2 {
-			logger.Printf("rtp packet version support 2, receive %d\n", pkt.Version)
-			pkt.release()
-			continue
-		}
-
-		val, ok := srv.sessions.Load(pkt.SSRC)
-		var sess *Session
-		if ok {
-			sess = val.(*Session)
-			sess.lastActiveTime = time.Now().UnixNano()
-		} else {
-			sess = newSession(pkt.SSRC, raddr, srv)
-			srv.sessions.Store(pkt.SSRC, sess)
-			select {
-			case srv.accept <- sess:
-				async(&srv.wg, func() {
-					err := sess.process()
-					sess.close()
-					srv.sessions.Delete(sess.ssrc)
-					if err != nil {
-						logger.Printf("process session ssrc=%v, err=%v\n", sess.ssrc, err)
-					}
-				})
-			default:
-				srv.sessions.Delete(pkt.SSRC)
-				logger.Println("session can't be accepted, will be drop")
-				goto NEXT
+func (srv *Server) handleRTCP(b []byte, raddr net.Addr) {
+	packets, err := UnmarshalRTCP(b)
+	if err != nil {
+		atomic.AddUint64(&srv.malformedPackets, 1)
+		srv.logger().Debug("rtcp packet unmarshal failed", "remote_addr", raddr.String(), "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, packet := range packets {
+		switch packet := packet.(type) {
+		case *SenderReport:
+			if sess := srv.rtcpSession(packet.SSRC, raddr); sess != nil {
+				sess.handleSenderReport(packet, raddr, now)
+			}
+		case *SourceDescription:
+			for _, chunk := range packet.Chunks {
+				if sess := srv.rtcpSession(chunk.Source, raddr); sess != nil {
+					sess.handleSourceDescription(packet, raddr)
+				}
+			}
+		case *Goodbye:
+			for _, ssrc := range packet.Sources {
+				if sess := srv.rtcpSession(ssrc, raddr); sess != nil {
+					sess.log().Info("session receive bye", "reason", packet.Reason)
+					sess.terminate(ErrSessionBye)
+				}
 			}
 		}
+	}
+}
+
+func (srv *Server) loopSendReports() {
+	ticker := time.NewTicker(srv.ReportInterval)
+	defer ticker.Stop()
+	for {
 		select {
-		case sess.receive <- pkt:
-		default:
-			logger.Printf("pkt can't be receive, will be drop. ssrc=%v seq=%v\n", pkt.SSRC, pkt.SequenceNumber)
+		case <-ticker.C:
+		case <-srv.closed:
+			return
 		}
-	NEXT:
-		runtime.Gosched()
+
+		now := time.Now()
+		srv.sessions.Range(func(key interface{}, val interface{}) bool {
+			sess := val.(*Session)
+			rr := sess.receiverReport(now)
+			if rr == nil {
+				return true
+			}
+			if err := srv.writeRTCP(sess, rr); err != nil {
+				sess.log().Warn("send receiver report failed", "err", err)
+			}
+			return true
+		})
+	}
+}
+
+// writeRTCP sends packets to the RTCP address of sess. The address is
+// learned from received RTCP, falling back to the port following the RTP
+// source port unless RTCP is multiplexed.
+func (srv *Server) writeRTCP(sess *Session, packets ...RTCPPacket) error {
+	b, err := MarshalRTCP(packets)
+	if err != nil {
+		return err
 	}
 
+	if conn := sess.tcpConn(); conn != nil {
+		return conn.writeFrame(b)
+	}
+
+	conn := srv.listener
+	if srv.rtcpConn != nil {
+		conn = srv.rtcpConn
+	}
+	sess.mux.RLock()
+	raddr, addr := sess.rtcpAddr, sess.addr
+	sess.mux.RUnlock()
+	if conn == nil {
+		return fmt.Errorf("no rtcp connection to session addr %v", addr)
+	}
+
+	if raddr == nil {
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return fmt.Errorf("session addr %v is not udp", addr)
+		}
+		if !srv.RTCPMux {
+			udpAddr = &net.UDPAddr{IP: udpAddr.IP, Port: udpAddr.Port + 1, Zone: udpAddr.Zone}
+		}
+		raddr = udpAddr
+	}
+
+	_, err = conn.WriteTo(b, raddr)
+	return err
+}
+
+func (srv *Server) logger() *slog.Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	return logger
+}
+
+// Sessions returns the sessions currently active on the server.
+func (srv *Server) Sessions() (sessions []*Session) {
+	if srv.sessions == nil {
+		return nil
+	}
 	srv.sessions.Range(func(key interface{}, val interface{}) bool {
-		sess := val.(*Session)
-		sess.close()
-		srv.sessions.Delete(key)
+		sessions = append(sessions, val.(*Session))
 		return true
 	})
+	return sessions
 }
 
 func (srv *Server) Close() (err error) {
 	srv.mux.Lock()
-	if srv.state != serverStatusRunning {
+	if srv.state != serverStatusRunning && srv.state != serverStatusDraining {
 		srv.mux.Unlock()
 		return fmt.Errorf("server is not running")
-	} else {
-		srv.state = serverStatusStopping
-		srv.mux.Unlock()
 	}
-	err = srv.listener.Close()
+	draining := srv.state == serverStatusDraining
+	srv.state = serverStatusStopping
+	srv.mux.Unlock()
+
+	if !draining {
+		err = srv.closeInput()
+	}
+	srv.closeSessions()
+	if srv.rtcpConn != nil {
+		srv.rtcpConn.Close()
+	}
 	close(srv.closed)
 	srv.wg.Wait()
 	srv.mux.Lock()
@@ -171,15 +576,98 @@ func (srv *Server) Close() (err error) {
 	return err
 }
 
-func (srv *Server) Accept() (sess *Session, err error) {
-	for {
+// Shutdown gracefully shuts down the server. It stops reading packets and
+// admitting sessions, lets every active session process the packets it
+// buffered and flush its processors, then closes the server. When ctx is
+// done first, the remaining sessions are closed and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mux.Lock()
+	if srv.state != serverStatusRunning {
+		srv.mux.Unlock()
+		return fmt.Errorf("server is not running")
+	}
+	srv.state = serverStatusDraining
+	close(srv.drain)
+	srv.mux.Unlock()
+
+	srv.closeInput()
+	// connections dialed by Dial
+	srv.sessions.Range(func(key interface{}, val interface{}) bool {
+		if conn := val.(*Session).tcpConn(); conn != nil {
+			conn.Close()
+		}
+		return true
+	})
+	srv.expected.Range(func(key interface{}, val interface{}) bool {
+		val.(*Session).terminate(ErrServerClosed)
+		return true
+	})
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for len(srv.Sessions()) > 0 {
 		select {
-		case sess = <-srv.accept:
-			return sess, nil
-		case <-srv.closed:
-			return nil, ErrServerClosed
+		case <-ticker.C:
+		case <-ctx.Done():
+			srv.Close()
+			return ctx.Err()
 		}
 	}
+	return srv.Close()
+}
+
+// closeInput closes the listeners and connections receiving packets.
+func (srv *Server) closeInput() (err error) {
+	if srv.listener != nil {
+		for _, listener := range srv.listeners {
+			if closeErr := listener.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	} else {
+		err = srv.tcpListener.Close()
+		srv.conns.Range(func(key interface{}, val interface{}) bool {
+			val.(*tcpConn).Close()
+			return true
+		})
+	}
+	return err
+}
+
+// draining reports whether Shutdown was called.
+func (srv *Server) draining() bool {
+	select {
+	case <-srv.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// MalformedPackets returns the number of received packets that failed to
+// unmarshal, e.g. because of invalid padding or header extension.
+func (srv *Server) MalformedPackets() uint64 {
+	return atomic.LoadUint64(&srv.malformedPackets)
+}
+
+func (srv *Server) Accept() (sess *Session, err error) {
+	return srv.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for the next session like Accept. It returns
+// ErrServerClosed once the server is shutting down, or ctx.Err() when ctx
+// is done first.
+func (srv *Server) AcceptContext(ctx context.Context) (sess *Session, err error) {
+	select {
+	case sess = <-srv.accept:
+		return sess, nil
+	case <-srv.drain:
+		return nil, ErrServerClosed
+	case <-srv.closed:
+		return nil, ErrServerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func async(wg *sync.WaitGroup, fn func()) {
@@ -1,103 +1,303 @@
 package rtp
 
 import (
+	"fmt"
+	"log/slog"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Session struct {
-	addr               net.Addr
-	ssrc               uint32
-	receive            chan *Packet
-	processor          Processor
-	mux                sync.RWMutex
-	closed             chan bool
-	lastActiveTime     int64
-	errch              chan error
-	lastSequenceNumber uint16
-	srv                *Server
-
-	buf       []*Packet
-	bufCap    uint16
-	bufOffset uint16
-	bufLen    uint16
-
-	tmpPkt *Packet
+	addr           net.Addr
+	conn           *tcpConn
+	ssrc           uint32
+	receive        chan *Packet
+	processor      Processor
+	mux            sync.RWMutex
+	closed         chan bool
+	lastActiveTime int64
+	srv            *Server
+	// err is the reason the session was closed
+	err error
+
+	stalled       int32
+	firstPacket   bool
+	firstKeyframe int32
+
+	jitter      *jitterBuffer
+	nackTimeout time.Duration
+
+	// resync holds a packet outside the jitter buffer window, delivered
+	// once the buffered packets are drained.
+	resync *Packet
+	// probation holds the packet received while the source is validated.
+	probation *Packet
+	// draining is set once the server shuts down
+	draining bool
 
 	timestamp uint32
-	seq       uint16
+
+	rtcpAddr   net.Addr
+	cname      string
+	lastSR     *SenderReport
+	lastSRTime time.Time
+
+	stats  *receptionStats
+	logger *slog.Logger
+
+	// key identifies the session in Server.sessions, see Server.Demux
+	key interface{}
+	// rejectedAddrs holds the addresses OnAddrChange refused to follow
+	rejectedAddrs map[string]bool
+
+	// expectKey is the ssrc or addr the session is registered for until
+	// its first packet arrives
+	expectKey interface{}
 }
 
 var defaultSessionBufCap = uint16(200)
 
+// Reasons returned by Session.Err once a session is closed. A session
+// ended by a processor failure returns the processor error wrapped, and a
+// session of a dropped tcp connection returns the connection error
+// wrapped.
+var (
+	ErrSessionClosed  = fmt.Errorf("session closed")
+	ErrSessionTimeout = fmt.Errorf("session timeout")
+	ErrSessionBye     = fmt.Errorf("session receive bye")
+)
+
 func newSession(ssrc uint32, addr net.Addr, srv *Server) *Session {
+	clockRate := srv.ClockRate
+	if clockRate == 0 {
+		clockRate = defaultClockRate
+	}
 	sess := &Session{
 		ssrc:    ssrc,
 		addr:    addr,
 		closed:  make(chan bool),
-		errch:   make(chan error, 1),
 		receive: make(chan *Packet, defaultSessionBufCap),
 		srv:     srv,
-		buf:     make([]*Packet, defaultSessionBufCap),
-		bufCap:  defaultSessionBufCap,
+		jitter:  newJitterBuffer(clockRate, srv.JitterTarget, srv.JitterMax, srv.NACKTimeout),
+		stats:   newReceptionStats(clockRate),
+
+		nackTimeout: srv.NACKTimeout,
+	}
+	if addr != nil {
+		sess.key = srv.sessionKey(ssrc, addr)
 	}
+	sess.setLogger()
 	return sess
 }
 
+func (sess *Session) setLogger() {
+	if sess.addr != nil {
+		sess.logger = sess.srv.logger().With("ssrc", sess.ssrc, "remote_addr", sess.addr.String())
+	} else {
+		sess.logger = sess.srv.logger().With("ssrc", sess.ssrc)
+	}
+}
+
+// Addr returns the remote address of the session, it is nil for an
+// expected session until its first packet arrives.
 func (sess *Session) Addr() net.Addr {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
 	return sess.addr
 }
 
 func (sess *Session) SSRC() uint32 {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
 	return sess.ssrc
 }
 
+// log returns the logger of the session, which is replaced when the session
+// follows a new ssrc or addr.
+func (sess *Session) log() *slog.Logger {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
+	return sess.logger
+}
+
+func (sess *Session) tcpConn() *tcpConn {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
+	return sess.conn
+}
+
+// Stats returns a snapshot of the reception statistics of the session.
+func (sess *Session) Stats() SessionStats {
+	return sess.stats.snapshot()
+}
+
+// CNAME returns the canonical name announced by the sender in RTCP SDES.
+func (sess *Session) CNAME() string {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
+	return sess.cname
+}
+
+// LastSenderReport returns the latest RTCP sender report and the time it
+// arrived, or nil if none was received.
+func (sess *Session) LastSenderReport() (sr *SenderReport, arrival time.Time) {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
+	return sess.lastSR, sess.lastSRTime
+}
+
+// Wallclock maps an RTP timestamp to the sender's NTP wallclock using the
+// latest sender report. ok is false until a sender report is received.
+func (sess *Session) Wallclock(timestamp uint32, clockRate uint32) (t time.Time, ok bool) {
+	sr, _ := sess.LastSenderReport()
+	if sr == nil || clockRate == 0 {
+		return time.Time{}, false
+	}
+	diff := int64(int32(timestamp - sr.RTPTime))
+	return ntpToTime(sr.NTPTime).Add(time.Duration(diff) * time.Second / time.Duration(clockRate)), true
+}
+
+// receiverReport builds an RTCP receiver report for the session, or nil if
+// no packet was received yet.
+func (sess *Session) receiverReport(now time.Time) *ReceiverReport {
+	report, ok := sess.stats.report(sess.SSRC())
+	if !ok {
+		return nil
+	}
+
+	sr, arrival := sess.LastSenderReport()
+	if sr != nil {
+		report.LastSenderReport = uint32(sr.NTPTime >> 16)
+		report.Delay = uint32(now.Sub(arrival) * 65536 / time.Second)
+	}
+
+	return &ReceiverReport{
+		SSRC:    sess.srv.ssrc,
+		Reports: []ReceptionReport{report},
+	}
+}
+
+func (sess *Session) handleSenderReport(sr *SenderReport, raddr net.Addr, now time.Time) {
+	sess.mux.Lock()
+	sess.lastSR = sr
+	sess.lastSRTime = now
+	sess.rtcpAddr = raddr
+	sess.mux.Unlock()
+}
+
+func (sess *Session) handleSourceDescription(sdes *SourceDescription, raddr net.Addr) {
+	sess.mux.Lock()
+	if cname := sdes.CNAME(sess.ssrc); cname != "" {
+		sess.cname = cname
+	}
+	sess.rtcpAddr = raddr
+	sess.mux.Unlock()
+}
+
 func (sess *Session) Attach(processor Processor) {
+	sess.mux.Lock()
+	setLogger(processor, sess.logger)
+	setKeyframeFunc(processor, sess.keyframe)
 	old := sess.processor
 	sess.processor = processor
+	sess.mux.Unlock()
 	if old != nil {
 		old.Release()
 	}
 }
 
-func (sess *Session) close() {
+// AttachPipeline builds desc, e.g. "ps -> flv -> rtmp://host/app/stream",
+// from DefaultRegistry and attaches it.
+func (sess *Session) AttachPipeline(desc string) error {
+	processor, err := DefaultRegistry.BuildString(desc)
+	if err != nil {
+		return err
+	}
+	sess.Attach(processor)
+	return nil
+}
+
+// close marks the session closed for reason, only the first reason is
+// kept.
+func (sess *Session) close(reason error) {
+	sess.mux.Lock()
+	defer sess.mux.Unlock()
 	select {
 	case <-sess.closed:
 	default:
+		sess.err = reason
 		close(sess.closed)
 	}
 }
 
+// terminate closes the session for reason and unregisters it.
+func (sess *Session) terminate(reason error) {
+	sess.close(reason)
+	sess.srv.removeSession(sess)
+	sess.srv.cancelExpect(sess)
+}
+
+// keyframe is called by the processors on every keyframe.
+func (sess *Session) keyframe() {
+	if atomic.CompareAndSwapInt32(&sess.firstKeyframe, 0, 1) && sess.srv.OnFirstKeyframe != nil {
+		sess.srv.OnFirstKeyframe(sess)
+	}
+}
+
+// received reports the lifecycle events of a packet received by the
+// session goroutine.
+func (sess *Session) received() {
+	srv := sess.srv
+	if !sess.firstPacket {
+		sess.firstPacket = true
+		if srv.OnFirstPacket != nil {
+			srv.OnFirstPacket(sess)
+		}
+	}
+	if atomic.CompareAndSwapInt32(&sess.stalled, 1, 0) && srv.OnResume != nil {
+		srv.OnResume(sess)
+	}
+}
+
 func (sess *Session) process() error {
-	lastPrintTime := time.Now().Unix()
-	lost := uint16(0)
-	duration := int64(60)
+	lastPrintTime := time.Now()
+	lastLost := int64(0)
+	duration := 60 * time.Second
 	for {
 		pkt := sess.pull()
 		if pkt == nil {
-			return nil
-		}
-
-		now := time.Now().Unix()
-		if pkt.SequenceNumber-sess.lastSequenceNumber > 1 && now-lastPrintTime > 5 {
-			lost = lost + pkt.SequenceNumber - sess.lastSequenceNumber
+			// the session is either closed or drained by Shutdown
+			select {
+			case <-sess.closed:
+				return nil
+			default:
+				return sess.flush()
+			}
 		}
 
-		if now-lastPrintTime > duration && lost > 0 {
-			logger.Printf("session ssrc=%d, loss %d packets in %ds, current seq: %d\n", pkt.SSRC, lost, now-lastPrintTime, pkt.SequenceNumber)
+		if now := time.Now(); now.Sub(lastPrintTime) > duration {
+			lost := sess.stats.snapshot().PacketsLost
+			if lost > lastLost {
+				sess.log().Info("session loss packets", "lost", lost-lastLost, "duration", now.Sub(lastPrintTime), "seq", pkt.ExtendedSequenceNumber())
+			}
 			lastPrintTime = now
-			lost = 0
+			lastLost = lost
 		}
 
-		if sess.processor != nil {
-			err := sess.processor.Process(pkt)
+		sess.mux.RLock()
+		processor := sess.processor
+		sess.mux.RUnlock()
+		if processor != nil {
+			pkt.wallclock, _ = sess.Wallclock(pkt.Timestamp, sess.stats.clockRate)
+			err := processor.Process(pkt)
 			// logger.Printf("ssrc %d, seq %v, err %v\n", pkt.SSRC, pkt.SequenceNumber, err)
 			pkt.release()
 			if err != nil {
-				logger.Println("session process err", err)
-				sess.errch <- err
+				atomic.AddUint64(&sess.srv.processorErrors, 1)
+				sess.log().Error("session process failed", "err", err)
 				return err
 			}
 		} else {
@@ -108,71 +308,174 @@ func (sess *Session) process() error {
 	}
 }
 
+// pull returns the next packet in sequence order, skipping the holes the
+// jitter buffer gave up on.
 func (sess *Session) pull() (pkt *Packet) {
-	pkt = sess.readBuf()
-	if pkt != nil {
-		sess.seq++
-		return pkt
-	}
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
 
+	jitter := sess.jitter
 	for {
-		if sess.tmpPkt != nil {
-			pkt, sess.tmpPkt = sess.tmpPkt, nil
-		} else {
-			select {
-			case pkt = <-sess.receive:
-			case <-sess.closed:
-				return nil
-			}
+		if pkt = jitter.pop(); pkt != nil {
+			return pkt
 		}
 
-		switch {
-		case pkt.SequenceNumber == sess.seq:
-			sess.seq++
+		if sess.resync != nil {
+			if jitter.len > 0 {
+				sess.skip()
+				continue
+			}
+			pkt, sess.resync = sess.resync, nil
+			if jitter.started {
+				// the packets between the buffer and the jump or
+				// restart are given up
+				sess.gap(jitter.seq, pkt.SequenceNumber-jitter.seq)
+			}
+			jitter.reset(pkt.SequenceNumber + 1)
 			return pkt
-		case pkt.SequenceNumber-sess.seq <= sess.bufCap:
-			sess.setBuf(pkt.SequenceNumber-sess.seq-1, pkt)
-		default:
-			bufLen := sess.bufLen
-			for i := uint16(0); i < bufLen; i++ {
-				read := sess.readBuf()
-				if read != nil {
-					sess.seq = read.SequenceNumber + 1
-					sess.tmpPkt = pkt
-					return read
+		}
+
+		drain := sess.srv.drain
+		var timeout <-chan time.Time
+		if sess.draining {
+			// the server is shutting down, deliver what is left without
+			// waiting for holes
+			if len(sess.receive) == 0 {
+				if jitter.len == 0 {
+					return nil
 				}
+				sess.skip()
+				continue
 			}
-			sess.seq = pkt.SequenceNumber + 1
-			sess.emptyBuf()
-			return pkt
+			drain = nil
+		} else if deadline, ok := jitter.deadline(); ok {
+			if timer == nil {
+				timer = time.NewTimer(time.Until(deadline))
+			} else {
+				timer.Reset(time.Until(deadline))
+			}
+			timeout = timer.C
+		}
+
+		select {
+		case pkt = <-sess.receive:
+			sess.received()
+		case <-timeout:
+			sess.skip()
+			continue
+		case <-drain:
+			sess.draining = true
+			continue
+		case <-sess.closed:
+			return nil
+		}
+		if timeout != nil && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		result, extended := sess.stats.update(pkt, pkt.arrival)
+		switch result {
+		case seqProbation:
+			if sess.probation != nil {
+				sess.probation.release()
+			}
+			sess.probation = pkt
+			continue
+		case seqInvalid:
+			pkt.release()
+			continue
+		case seqRestart:
+			sess.log().Info("session sequence restarted", "seq", pkt.SequenceNumber)
+			pkt.extended = extended
+			sess.resync = pkt
+			continue
+		}
+
+		pkt.extended = extended
+		if held := sess.probation; held != nil {
+			sess.probation = nil
+			held.extended = extended - 1
+			sess.push(held)
 		}
+		sess.push(pkt)
 	}
 }
 
-func (sess *Session) readBuf() (pkt *Packet) {
-	if sess.bufLen == 0 {
-		return nil
+// push stores pkt in the jitter buffer.
+func (sess *Session) push(pkt *Packet) {
+	result, offset := sess.jitter.push(pkt)
+	switch result {
+	case pushInSequence:
+		sess.jitter.adapt(sess.stats.jitterDuration())
+		if offset > 0 && sess.nackTimeout > 0 {
+			sess.requestRetransmission(offset)
+		}
+	case pushDuplicate:
+		sess.stats.duplicate()
+		pkt.release()
+	case pushLate:
+		sess.stats.lateDrop()
+		pkt.release()
+	case pushResync:
+		sess.resync = pkt
 	}
-	pkt, sess.buf[sess.bufOffset] = sess.buf[sess.bufOffset], nil
-	sess.bufOffset++
-	sess.bufLen--
-	if sess.bufOffset == sess.bufCap {
-		sess.bufOffset = 0
+}
+
+// flush flushes the processor of a drained session.
+func (sess *Session) flush() error {
+	sess.mux.RLock()
+	processor := sess.processor
+	sess.mux.RUnlock()
+	if err := flush(processor); err != nil {
+		sess.log().Warn("session flush failed", "err", err)
+		return err
 	}
-	return pkt
+	return nil
 }
 
-func (sess *Session) setBuf(offset uint16, pkt *Packet) {
-	offset = (sess.bufOffset + offset) % sess.bufCap
-	if offset+1 > sess.bufLen {
-		sess.bufLen = offset + 1
+// skip gives up the holes at the head of the jitter buffer and notifies
+// the processor.
+func (sess *Session) skip() {
+	sess.gap(sess.jitter.skip())
+}
+
+// gap notifies the processor of count packets skipped from seq.
+func (sess *Session) gap(seq uint16, count uint16) {
+	if count == 0 {
+		return
+	}
+
+	sess.mux.RLock()
+	processor := sess.processor
+	sess.mux.RUnlock()
+	if handler, ok := processor.(GapHandler); ok {
+		handler.Gap(Gap{SSRC: sess.SSRC(), SequenceNumber: seq, Count: count})
 	}
-	sess.buf[offset] = pkt
 }
 
-func (sess *Session) emptyBuf() {
-	sess.bufOffset = 0
-	sess.bufLen = 0
+// requestRetransmission sends a generic NACK for the holes before offset
+// that were not requested yet.
+func (sess *Session) requestRetransmission(offset uint16) {
+	lost := sess.jitter.missing(offset, time.Now())
+	if len(lost) == 0 {
+		return
+	}
+
+	nack := &GenericNACK{
+		SenderSSRC: sess.srv.ssrc,
+		MediaSSRC:  sess.SSRC(),
+		Lost:       lost,
+	}
+	if err := sess.srv.writeRTCP(sess, nack); err != nil {
+		sess.log().Warn("send nack failed", "err", err)
+	}
 }
 
 func (sess *Session) release() {
@@ -186,17 +489,22 @@ func (sess *Session) release() {
 	}
 }
 
+// Wait blocks until the session is closed and returns the reason, see
+// Err.
 func (sess *Session) Wait() error {
-	select {
-	case <-sess.closed:
-		return nil
-	case err := <-sess.errch:
-		return err
-	}
+	<-sess.closed
+	return sess.Err()
+}
 
+// Err returns nil while the session is open, then the reason it was
+// closed: ErrSessionClosed, ErrSessionTimeout, ErrSessionBye,
+// ErrServerClosed, or a wrapped processor or connection error.
+func (sess *Session) Err() error {
+	sess.mux.RLock()
+	defer sess.mux.RUnlock()
+	return sess.err
 }
 
 func (sess *Session) Close() {
-	sess.close()
-	sess.srv.sessions.Delete(sess.ssrc)
+	sess.terminate(ErrSessionClosed)
 }
@@ -0,0 +1,96 @@
+package rtp
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+type releaseRecorder struct {
+	released chan bool
+}
+
+func (recorder *releaseRecorder) Process(frame *Frame) error { return nil }
+
+func (recorder *releaseRecorder) Release() {
+	close(recorder.released)
+}
+
+func TestSessionReleasesPipeline(t *testing.T) {
+	released := make(chan bool)
+	DefaultRegistry.Register("release-test", StageFactory{In: MediaFrame, New: func(arg string) (interface{}, error) {
+		return &releaseRecorder{released: released}, nil
+	}})
+
+	for _, activate := range []bool{true, false} {
+		released = make(chan bool)
+		srv := &Server{Addr: "127.0.0.1:0", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+		if err := srv.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := srv.Expect(1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.AttachPipeline("h264 -> async -> tee(release-test)"); err != nil {
+			t.Fatal(err)
+		}
+
+		if activate {
+			conn, err := net.Dial("udp", srv.listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := NewPacketBuilder(1, 96, 0).Build([]byte{0x65}, 0, true).Marshal()
+			conn.Write(b)
+			conn.Close()
+			for deadline := time.Now().Add(5 * time.Second); sess.Addr() == nil; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("expected session not activated")
+				}
+			}
+		}
+
+		sess.Close()
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("pipeline not released, session activated %v", activate)
+		}
+		srv.Close()
+	}
+}
+
+func TestSessionGapOnResync(t *testing.T) {
+	srv := &Server{}
+	sess := newSession(1, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}, srv)
+	unblock := make(chan bool)
+	close(unblock)
+	recorder := &packetRecorder{unblock: unblock}
+	sess.Attach(recorder)
+
+	// 1102 is beyond the jitter buffer, 30001 restarts the sequence
+	builder := NewPacketBuilder(1, 96, 0)
+	for _, seq := range []uint16{100, 101, 102, 1102, 30000, 30001} {
+		builder.SequenceNumber = seq
+		sess.receive <- builder.Build(nil, 0, false)
+	}
+	for _, want := range []uint16{100, 101, 102, 1102, 30001} {
+		pkt := sess.pull()
+		if pkt == nil || pkt.SequenceNumber != want {
+			t.Fatalf("got packet %v, want seq %d", pkt, want)
+		}
+	}
+
+	want := []string{"gap 103+999", "gap 1103+28898"}
+	if len(recorder.events) != len(want) {
+		t.Fatalf("got %v, want %v", recorder.events, want)
+	}
+	for i := range want {
+		if recorder.events[i] != want[i] {
+			t.Fatalf("got %v, want %v", recorder.events, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package rtp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpConn carries RTP and RTCP framed with a 2 byte length prefix as
+// described in RFC 4571.
+type tcpConn struct {
+	net.Conn
+	reader *bufio.Reader
+	wmux   sync.Mutex
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	return &tcpConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// readFrame reads the next frame into buf, growing it when needed.
+func (conn *tcpConn) readFrame(buf []byte) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(conn.reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (conn *tcpConn) writeFrame(b []byte) error {
+	if len(b) > 0xFFFF {
+		return fmt.Errorf("rtp frame too large: %d", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	conn.wmux.Lock()
+	defer conn.wmux.Unlock()
+	_, err := conn.Write(frame)
+	return err
+}
+
+func (srv *Server) loopHandleAccept() {
+	for {
+		conn, err := srv.tcpListener.Accept()
+		if err != nil {
+			break
+		}
+
+		tconn := newTCPConn(conn)
+		srv.conns.Store(tconn, tconn)
+		async(&srv.wg, func() {
+			srv.serveConn(tconn)
+			srv.conns.Delete(tconn)
+		})
+	}
+
+	if !srv.draining() {
+		srv.closeSessions()
+	}
+}
+
+// serveConn reads frames from conn until it is closed, then closes every
+// session created by the connection.
+func (srv *Server) serveConn(conn *tcpConn) {
+	defer conn.Close()
+
+	sessions := make(map[*Session]bool)
+	var buf []byte
+	var err error
+	for {
+		buf, err = conn.readFrame(buf)
+		if err != nil {
+			break
+		}
+
+		if sess := srv.handlePacket(buf, conn.RemoteAddr(), conn); sess != nil {
+			sessions[sess] = true
+		}
+		runtime.Gosched()
+	}
+
+	if err != io.EOF {
+		srv.logger().Debug("rtp tcp connection closed", "remote_addr", conn.RemoteAddr().String(), "err", err)
+	}
+	if srv.draining() {
+		return
+	}
+	for sess := range sessions {
+		sess.terminate(fmt.Errorf("session connection closed: %w", err))
+	}
+}
+
+var defaultDialTimeout = 5 * time.Second
+
+// ReconnectPolicy controls how a dialed session reconnects after its
+// connection drops.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of reconnect attempts after the connection
+	// drops. Zero never reconnects and a negative value retries forever.
+	MaxAttempts int
+	// Interval is the delay before every reconnect attempt.
+	Interval time.Duration
+	// DialTimeout bounds every connect, it defaults to 5 seconds.
+	DialTimeout time.Duration
+}
+
+// Dial connects to a device pushing RTP over TCP on the accepted
+// connection, the GB28181 active mode, and returns the session reading
+// from it. Every packet received on the connection is delivered to the
+// session whatever its SSRC; ssrc identifies the session for RTCP. The
+// packets are processed by processor, which is attached before the first
+// one is read.
+func (srv *Server) Dial(addr string, ssrc uint32, processor Processor, policy ReconnectPolicy) (sess *Session, err error) {
+	srv.mux.Lock()
+	running := srv.state == serverStatusRunning
+	srv.mux.Unlock()
+	if !running {
+		return nil, fmt.Errorf("server is not running")
+	}
+
+	conn, err := dialTCP(addr, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	sess = newSession(ssrc, conn.RemoteAddr(), srv)
+	sess.conn = conn
+	if !srv.addSession(sess) {
+		conn.Close()
+		return nil, fmt.Errorf("session ssrc=%d exists", ssrc)
+	}
+	if processor != nil {
+		sess.Attach(processor)
+	}
+	atomic.StoreInt64(&sess.lastActiveTime, time.Now().UnixNano())
+	atomic.AddUint64(&srv.acceptedSessions, 1)
+	srv.startSession(sess, nil)
+
+	async(&srv.wg, func() {
+		select {
+		case <-sess.closed:
+		case <-srv.closed:
+		}
+		sess.tcpConn().Close()
+	})
+	async(&srv.wg, func() {
+		srv.serveDialedConn(sess, addr, policy)
+	})
+	return sess, nil
+}
+
+func dialTCP(addr string, policy ReconnectPolicy) (*tcpConn, error) {
+	timeout := policy.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(conn), nil
+}
+
+// serveDialedConn reads frames for sess, reconnecting according to policy
+// until the session or the server is closed.
+func (srv *Server) serveDialedConn(sess *Session, addr string, policy ReconnectPolicy) {
+	reason := ErrSessionClosed
+	defer func() {
+		// a draining session closes itself once processed
+		if !srv.draining() {
+			sess.terminate(reason)
+		}
+	}()
+
+	var buf []byte
+	for {
+		conn := sess.tcpConn()
+		raddr := conn.RemoteAddr()
+		var err error
+		for {
+			buf, err = conn.readFrame(buf)
+			if err != nil {
+				break
+			}
+
+			if isRTCP(buf) {
+				srv.handleRTCP(buf, raddr)
+				continue
+			}
+			if pkt := srv.parsePacket(buf, raddr); pkt != nil {
+				srv.deliver(sess, pkt)
+			}
+			runtime.Gosched()
+		}
+		conn.Close()
+
+		select {
+		case <-sess.closed:
+			return
+		case <-srv.closed:
+			reason = ErrServerClosed
+			return
+		case <-srv.drain:
+			return
+		default:
+		}
+		sess.log().Warn("rtp tcp connection dropped", "err", err)
+
+		conn = srv.redial(sess, addr, policy)
+		if conn == nil {
+			reason = fmt.Errorf("session connection closed: %w", err)
+			return
+		}
+		sess.mux.Lock()
+		sess.conn = conn
+		sess.mux.Unlock()
+
+		// the session may have closed while redialing, after the watcher
+		// closed the previous connection
+		select {
+		case <-sess.closed:
+			conn.Close()
+			return
+		case <-srv.closed:
+			conn.Close()
+			reason = ErrServerClosed
+			return
+		default:
+		}
+	}
+}
+
+func (srv *Server) redial(sess *Session, addr string, policy ReconnectPolicy) *tcpConn {
+	for attempt := 0; policy.MaxAttempts < 0 || attempt < policy.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(policy.Interval):
+		case <-sess.closed:
+			return nil
+		case <-srv.closed:
+			return nil
+		}
+
+		conn, err := dialTCP(addr, policy)
+		if err == nil {
+			sess.log().Info("rtp tcp connection reconnected", "attempt", attempt+1)
+			return conn
+		}
+		sess.log().Warn("rtp tcp reconnect failed", "attempt", attempt+1, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package rtp
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+var ErrTeeBranchExists = fmt.Errorf("tee branch exists")
+
+var defaultTeeQueueSize = 64
+
+// Tee is a stage feeding every value to a set of branches, e.g. to publish
+// a stream to rtmp while recording it. Every branch is an Async stage
+// processing clones of the values on its own goroutine behind a bounded
+// queue: a slow branch drops values instead of blocking the others, and a
+// failing branch is removed without failing the tee. Branches are added and
+// removed while the tee is running.
+//
+// A full branch of frames or FLV tags drops values until the next keyframe,
+// and a full branch of packets drops the oldest ones, reported as a Gap.
+type Tee[T interface{ Clone() T }] struct {
+	// OnBranchError, when set, is called when a branch fails and is
+	// removed.
+	OnBranchError func(name string, err error)
+
+	mux        sync.Mutex
+	branches   map[string]*teeBranch[T]
+	queueSize  int
+	logger     *slog.Logger
+	onKeyframe func()
+}
+
+type teeBranch[T interface{ Clone() T }] struct {
+	name  string
+	async *Async[T]
+}
+
+// BranchStats is a snapshot of a tee branch.
+type BranchStats struct {
+	Name string
+	// Queued is the number of values waiting for the branch.
+	Queued  int
+	Dropped uint64
+}
+
+// NewTee returns a tee whose branches queue up to queueSize values, it
+// defaults to 64.
+func NewTee[T interface{ Clone() T }](queueSize int) *Tee[T] {
+	if queueSize <= 0 {
+		queueSize = defaultTeeQueueSize
+	}
+	return &Tee[T]{
+		branches:  make(map[string]*teeBranch[T]),
+		queueSize: queueSize,
+		logger:    logger,
+	}
+}
+
+// teeBranchPolicy returns the policy of the branches of a tee of T.
+func teeBranchPolicy[T any]() AsyncPolicy {
+	if detectsKeyframes(*new(T)) {
+		return AsyncDropUntilKeyframe
+	}
+	return AsyncDropOldest
+}
+
+// Add starts a branch feeding next.
+func (tee *Tee[T]) Add(name string, next Stage[T]) error {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	if _, ok := tee.branches[name]; ok {
+		return ErrTeeBranchExists
+	}
+
+	async := NewAsync[T](tee.queueSize, teeBranchPolicy[T]())
+	async.SetLogger(tee.logger)
+	async.SetKeyframeFunc(tee.onKeyframe)
+	async.Attach(next)
+	branch := &teeBranch[T]{name: name, async: async}
+	async.onError = func(err error) {
+		tee.branchFailed(branch, err)
+	}
+	tee.branches[name] = branch
+	return nil
+}
+
+// Remove stops the branch name, which releases its stage once its queue is
+// processed. It returns false if there is no such branch.
+func (tee *Tee[T]) Remove(name string) bool {
+	tee.mux.Lock()
+	branch, ok := tee.branches[name]
+	delete(tee.branches, name)
+	tee.mux.Unlock()
+
+	if ok {
+		branch.async.Release()
+	}
+	return ok
+}
+
+// Stats returns a snapshot of every branch.
+func (tee *Tee[T]) Stats() (stats []BranchStats) {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	for _, branch := range tee.branches {
+		asyncStats := branch.async.Stats()
+		stats = append(stats, BranchStats{
+			Name:    branch.name,
+			Queued:  asyncStats.Queued,
+			Dropped: asyncStats.Dropped,
+		})
+	}
+	return stats
+}
+
+// Process queues a clone of v to every branch with room for it. It never
+// fails, branch errors only remove the failing branch.
+func (tee *Tee[T]) Process(v T) error {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	for _, branch := range tee.branches {
+		branch.async.Process(v)
+	}
+	return nil
+}
+
+// Gap is queued to every branch.
+func (tee *Tee[T]) Gap(gap Gap) {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	for _, branch := range tee.branches {
+		branch.async.Gap(gap)
+	}
+}
+
+// Flush waits for every branch to process its queue and flushes it.
+func (tee *Tee[T]) Flush() error {
+	tee.mux.Lock()
+	branches := make([]*teeBranch[T], 0, len(tee.branches))
+	for _, branch := range tee.branches {
+		branches = append(branches, branch)
+	}
+	tee.mux.Unlock()
+
+	var err error
+	for _, branch := range branches {
+		// a failed branch is removed, its error is not a flush error
+		if flushErr := branch.async.Flush(); flushErr != nil && branch.async.Err() == nil && err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Release stops every branch.
+func (tee *Tee[T]) Release() {
+	tee.mux.Lock()
+	branches := tee.branches
+	tee.branches = make(map[string]*teeBranch[T])
+	tee.mux.Unlock()
+
+	for _, branch := range branches {
+		branch.async.Release()
+	}
+}
+
+func (tee *Tee[T]) SetLogger(logger *slog.Logger) {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	tee.logger = logger
+	for _, branch := range tee.branches {
+		branch.async.SetLogger(logger)
+	}
+}
+
+func (tee *Tee[T]) SetKeyframeFunc(fn func()) {
+	tee.mux.Lock()
+	defer tee.mux.Unlock()
+	tee.onKeyframe = fn
+	for _, branch := range tee.branches {
+		branch.async.SetKeyframeFunc(fn)
+	}
+}
+
+// branchFailed removes branch, called on its goroutine once its stage
+// failed.
+func (tee *Tee[T]) branchFailed(branch *teeBranch[T], err error) {
+	tee.logger.Warn("tee branch failed, will be removed", "branch", branch.name, "err", err)
+	tee.mux.Lock()
+	if tee.branches[branch.name] == branch {
+		delete(tee.branches, branch.name)
+	}
+	tee.mux.Unlock()
+	if tee.OnBranchError != nil {
+		tee.OnBranchError(branch.name, err)
+	}
+}
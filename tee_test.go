@@ -0,0 +1,107 @@
+package rtp
+
+import (
+	"testing"
+)
+
+type keyframeRecorder struct {
+	packetRecorder
+	onKeyframe func()
+}
+
+func (recorder *keyframeRecorder) SetKeyframeFunc(fn func()) {
+	recorder.onKeyframe = fn
+}
+
+func TestTeeForwardsGapAndKeyframeFunc(t *testing.T) {
+	unblock := make(chan bool)
+	close(unblock)
+	recorders := []*keyframeRecorder{
+		{packetRecorder: packetRecorder{unblock: unblock}},
+		{packetRecorder: packetRecorder{unblock: unblock}},
+	}
+	tee := NewTee[*Packet](0)
+	tee.Add("a", recorders[0])
+	keyframes := 0
+	tee.SetKeyframeFunc(func() { keyframes++ })
+	tee.Add("b", recorders[1])
+
+	builder := NewPacketBuilder(1, 96, 0)
+	tee.Process(builder.Build(nil, 0, false))
+	tee.Gap(Gap{SSRC: 1, SequenceNumber: 1, Count: 3})
+	builder.SequenceNumber = 4
+	tee.Process(builder.Build(nil, 0, false))
+	if err := tee.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tee.Release()
+
+	want := []string{"seq 0", "gap 1+3", "seq 4"}
+	for _, recorder := range recorders {
+		if len(recorder.events) != len(want) {
+			t.Fatalf("got %v, want %v", recorder.events, want)
+		}
+		for i := range want {
+			if recorder.events[i] != want[i] {
+				t.Fatalf("got %v, want %v", recorder.events, want)
+			}
+		}
+		if recorder.onKeyframe == nil {
+			t.Fatal("branch has no keyframe func")
+		}
+		recorder.onKeyframe()
+	}
+	if keyframes != 2 {
+		t.Fatalf("got %d keyframes, want 2", keyframes)
+	}
+}
+
+type frameRecorder struct {
+	started chan bool
+	unblock chan bool
+	frames  []uint32
+}
+
+func (recorder *frameRecorder) Process(frame *Frame) error {
+	if recorder.started != nil {
+		close(recorder.started)
+		recorder.started = nil
+	}
+	<-recorder.unblock
+	recorder.frames = append(recorder.frames, frame.Timestamp)
+	return nil
+}
+
+func (recorder *frameRecorder) Release() {}
+
+func TestTeeDropsFramesUntilKeyframe(t *testing.T) {
+	recorder := &frameRecorder{started: make(chan bool), unblock: make(chan bool)}
+	started := recorder.started
+	tee := NewTee[*Frame](2)
+	tee.Add("slow", recorder)
+
+	tee.Process(&Frame{Keyframe: true, Timestamp: 0})
+	<-started
+	// 1 and 2 fill the queue, 3 overflows it and 4 depends on it
+	for ts := uint32(1); ts <= 4; ts++ {
+		tee.Process(&Frame{Timestamp: ts})
+	}
+	tee.Process(&Frame{Keyframe: true, Timestamp: 5})
+	tee.Process(&Frame{Timestamp: 6})
+	close(recorder.unblock)
+	tee.Flush()
+	tee.Release()
+
+	want := []uint32{0, 5, 6}
+	if len(recorder.frames) != len(want) {
+		t.Fatalf("got frames %v, want %v", recorder.frames, want)
+	}
+	for i := range want {
+		if recorder.frames[i] != want[i] {
+			t.Fatalf("got frames %v, want %v", recorder.frames, want)
+		}
+	}
+	if stats := tee.Stats(); len(stats) != 0 {
+		t.Fatalf("released tee has branches %v", stats)
+	}
+}
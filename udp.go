@@ -0,0 +1,174 @@
+package rtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var defaultReadBatch = 16
+
+// batchReader reads several datagrams with a single system call, recvmmsg
+// on linux.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type ipv6BatchReader struct {
+	conn *ipv6.PacketConn
+}
+
+func (reader ipv6BatchReader) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return reader.conn.ReadBatch(ms, flags)
+}
+
+func newBatchReader(conn *net.UDPConn) batchReader {
+	if laddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && laddr.IP.To4() == nil && !laddr.IP.IsUnspecified() {
+		return ipv6BatchReader{conn: ipv6.NewPacketConn(conn)}
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// listenUDP opens the Readers sockets of the server on Addr.
+func (srv *Server) listenUDP() (listeners []*net.UDPConn, err error) {
+	readers := srv.Readers
+	if readers <= 0 {
+		readers = 1
+	}
+	if readers > 1 && reusePortControl == nil {
+		return nil, fmt.Errorf("multiple readers need SO_REUSEPORT, not supported on %s", runtime.GOOS)
+	}
+
+	config := net.ListenConfig{}
+	if readers > 1 {
+		config.Control = reusePortControl
+	}
+
+	addr := srv.Addr
+	for i := 0; i < readers; i++ {
+		conn, err := config.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, conn.(*net.UDPConn))
+		// bind the next sockets to the port chosen for the first one
+		addr = conn.LocalAddr().String()
+	}
+	if readers > 1 {
+		if err := shardBySSRC(listeners[0], readers); err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+	}
+	return listeners, nil
+}
+
+// udpReader reads batches of datagrams from a socket directly into pooled
+// packet buffers, so a packet is parsed in place without copying. A
+// datagram larger than the buffer is counted as malformed.
+type udpReader struct {
+	srv    *Server
+	reader batchReader
+	msgs   []ipv4.Message
+	pkts   []*Packet
+}
+
+func (srv *Server) newUDPReader(conn *net.UDPConn) *udpReader {
+	batch := srv.ReadBatch
+	if batch <= 0 {
+		batch = defaultReadBatch
+	}
+
+	r := &udpReader{
+		srv:    srv,
+		reader: newBatchReader(conn),
+		msgs:   make([]ipv4.Message, batch),
+		pkts:   make([]*Packet, batch),
+	}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return r
+}
+
+// read reads and dispatches a batch, it returns the number of datagrams
+// read.
+func (r *udpReader) read() (int, error) {
+	for i := range r.msgs {
+		if r.pkts[i] == nil {
+			r.pkts[i] = r.srv.pktPool.Get().(*Packet)
+		}
+		r.msgs[i].Buffers[0] = r.pkts[i].buf[:cap(r.pkts[i].buf)]
+	}
+
+	n, err := r.reader.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		pkt := r.pkts[i]
+		r.pkts[i] = nil
+		msg := &r.msgs[i]
+		if msg.Flags&msgTrunc != 0 {
+			atomic.AddUint64(&r.srv.malformedPackets, 1)
+			r.srv.logger().Debug("rtp packet truncated", "remote_addr", msg.Addr.String(), "size", msg.N)
+			pkt.release()
+			continue
+		}
+		r.srv.handleDatagram(pkt, pkt.buf[:msg.N], msg.Addr, now)
+	}
+	return n, nil
+}
+
+// release returns the buffers of the next batch to the pool.
+func (r *udpReader) release() {
+	for i, pkt := range r.pkts {
+		if pkt != nil {
+			pkt.release()
+			r.pkts[i] = nil
+		}
+	}
+}
+
+func (srv *Server) loopHandleRead(conn *net.UDPConn) {
+	reader := srv.newUDPReader(conn)
+	defer reader.release()
+	for {
+		if _, err := reader.read(); err != nil {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	if !srv.draining() {
+		srv.closeSessions()
+	}
+}
+
+// handleDatagram dispatches a datagram read into the buffer of pkt.
+func (srv *Server) handleDatagram(pkt *Packet, b []byte, raddr net.Addr, arrival time.Time) {
+	if srv.RTCPMux && isRTCP(b) {
+		srv.handleRTCP(b, raddr)
+		pkt.release()
+		return
+	}
+
+	pkt.arrival = arrival
+	if !srv.validPacket(pkt, pkt.parse(b), raddr) {
+		return
+	}
+	srv.dispatch(pkt, raddr, nil)
+}
@@ -0,0 +1,180 @@
+package rtp
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchmarkPayloadSize = 1200
+	benchmarkSources     = 4
+	// benchmarkRound is the number of packets queued in the socket buffers
+	// before each timed read, few enough to fit the default buffer size.
+	benchmarkRound = 64
+)
+
+// benchmarkServer serves on loopback, rejecting every session so the
+// benchmarks measure reading, parsing and demultiplexing alone. The
+// benchmarks read their own sockets, opened like the ones of the server.
+func benchmarkServer(b *testing.B, readers, batch int) (*Server, []*net.UDPConn) {
+	srv := &Server{
+		Addr:      "127.0.0.1:0",
+		Readers:   readers,
+		ReadBatch: batch,
+		Admission: AdmitFunc(func(srv *Server, ssrc uint32, raddr net.Addr) bool {
+			return false
+		}),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	if err := srv.Serve(); err != nil {
+		b.Fatal(err)
+	}
+	listeners, err := srv.listenUDP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		srv.Close()
+	})
+	return srv, listeners
+}
+
+// packetSender sends the packets of benchmarkSources SSRCs, each from its
+// own port.
+type packetSender struct {
+	conns    []net.Conn
+	builders []*PacketBuilder
+	payload  []byte
+	buf      []byte
+	next     int
+}
+
+func newPacketSender(b *testing.B, addr net.Addr) *packetSender {
+	sender := &packetSender{
+		payload: make([]byte, benchmarkPayloadSize),
+		buf:     make([]byte, maxUDPPacketSize),
+	}
+	for i := 0; i < benchmarkSources; i++ {
+		conn, err := net.Dial("udp", addr.String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		sender.conns = append(sender.conns, conn)
+		sender.builders = append(sender.builders, NewPacketBuilder(uint32(i+1), 96, 0))
+	}
+	b.Cleanup(func() {
+		for _, conn := range sender.conns {
+			conn.Close()
+		}
+	})
+	return sender
+}
+
+// send sends n packets round robin over the sources and returns the number
+// sent by each source.
+func (sender *packetSender) send(n int) (sent []int) {
+	sent = make([]int, len(sender.conns))
+	for ; n > 0; n-- {
+		i := sender.next
+		sender.next = (sender.next + 1) % len(sender.conns)
+		size, _ := sender.builders[i].Build(sender.payload, 0, false).MarshalTo(sender.buf)
+		sender.conns[i].Write(sender.buf[:size])
+		sent[i]++
+	}
+	return sent
+}
+
+// benchmarkRead times read draining rounds of packets queued in the socket
+// buffers of conns beforehand, so it reports the cost of receiving a
+// packet. read reads a socket and returns the number of packets read; the
+// sockets are read concurrently, each getting the sources its SSRC
+// sharding filter selects.
+func benchmarkRead(b *testing.B, conns []*net.UDPConn, read func(i int) (int, error)) {
+	sender := newPacketSender(b, conns[0].LocalAddr())
+	for _, conn := range conns {
+		conn.SetReadBuffer(1 << 20)
+	}
+
+	b.SetBytes(benchmarkPayloadSize)
+	b.ResetTimer()
+	for done := 0; done < b.N; done += benchmarkRound {
+		b.StopTimer()
+		queued := make([]int, len(conns))
+		for i, n := range sender.send(min(benchmarkRound, b.N-done)) {
+			// the sources are numbered from 1, as the SSRCs
+			queued[(i+1)%len(conns)] += n
+		}
+		// a read blocking until the deadline lost packets
+		deadline := time.Now().Add(5 * time.Second)
+		for _, conn := range conns {
+			conn.SetReadDeadline(deadline)
+		}
+		b.StartTimer()
+
+		var wg sync.WaitGroup
+		for i := range conns {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for queued[i] > 0 {
+					n, err := read(i)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					queued[i] -= n
+				}
+			}(i)
+		}
+		wg.Wait()
+		if b.Failed() {
+			b.FailNow()
+		}
+	}
+}
+
+// BenchmarkReadFrom reads a datagram per system call into a fresh buffer
+// copied into the packet, as the server did before batched reads.
+func BenchmarkReadFrom(b *testing.B) {
+	srv, conns := benchmarkServer(b, 1, 0)
+	benchmarkRead(b, conns, func(i int) (int, error) {
+		buf := make([]byte, maxUDPPacketSize)
+		n, raddr, err := conns[i].ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		srv.handlePacket(buf[:n], raddr, nil)
+		return 1, nil
+	})
+}
+
+func benchmarkReadBatch(b *testing.B, readers, batch int) {
+	srv, conns := benchmarkServer(b, readers, batch)
+	udpReaders := make([]*udpReader, len(conns))
+	for i, conn := range conns {
+		udpReaders[i] = srv.newUDPReader(conn)
+		defer udpReaders[i].release()
+	}
+	benchmarkRead(b, conns, func(i int) (int, error) {
+		return udpReaders[i].read()
+	})
+}
+
+func BenchmarkReadBatch1(b *testing.B) {
+	benchmarkReadBatch(b, 1, 1)
+}
+
+func BenchmarkReadBatch16(b *testing.B) {
+	benchmarkReadBatch(b, 1, 16)
+}
+
+func BenchmarkReadBatch16Readers4(b *testing.B) {
+	benchmarkReadBatch(b, 4, 16)
+}